@@ -0,0 +1,455 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// compression formats recognised by decompress
+const (
+	compressionNone  = "none"
+	compressionGzip  = "gzip"
+	compressionBzip2 = "bzip2"
+	compressionXz    = "xz"
+	compressionZstd  = "zstd"
+	compressionLzip  = "lzip"
+	compressionLzma  = "lzma"
+)
+
+// container formats recognised by extractArchive
+const (
+	containerTar = "tar"
+	containerZip = "zip"
+)
+
+// formats maps the names accepted by fetch(format=...) to a compression and container format
+var formats = map[string][2]string{
+	"tar":      {compressionNone, containerTar},
+	"tar.gz":   {compressionGzip, containerTar},
+	"tgz":      {compressionGzip, containerTar},
+	"tar.bz2":  {compressionBzip2, containerTar},
+	"tbz2":     {compressionBzip2, containerTar},
+	"tar.xz":   {compressionXz, containerTar},
+	"txz":      {compressionXz, containerTar},
+	"tar.zst":  {compressionZstd, containerTar},
+	"tzst":     {compressionZstd, containerTar},
+	"tar.lz":   {compressionLzip, containerTar},
+	"tar.lzma": {compressionLzma, containerTar},
+	"zip":      {compressionNone, containerZip},
+}
+
+// sniffLen is the number of bytes needed to recognise any supported compression or container format
+const sniffLen = 512
+
+// sniffCompression identifies the compression format from the magic bytes at the start of a stream
+func sniffCompression(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return compressionGzip
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return compressionBzip2
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return compressionXz
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return compressionZstd
+	case bytes.HasPrefix(header, []byte("LZIP")):
+		return compressionLzip
+	case len(header) >= lzma.HeaderLen && header[0] == 0x5d && (header[12] == 0x00 || header[12] == 0xff):
+		// lzma alone has no magic, this matches the default properties with a sane uncompressed size
+		return compressionLzma
+	}
+	return compressionNone
+}
+
+// sniffContainer identifies the archive format of an uncompressed stream
+func sniffContainer(header []byte) string {
+	if bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06")) {
+		return containerZip
+	}
+
+	// anything else is handed to the tar reader, pre POSIX tarballs have no magic to test for
+	return containerTar
+}
+
+// decompress wraps reader with a decompressor for compression, the returned closer releases it
+func decompress(reader *bufio.Reader, compression string) (io.Reader, func(), error) {
+	noop := func() {}
+
+	switch compression {
+	case compressionNone:
+		return reader, noop, nil
+
+	case compressionGzip:
+		gzipStream, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, noop, err
+		}
+		return gzipStream, func() {
+			if err := gzipStream.Close(); err != nil {
+				warn(err.Error())
+			}
+		}, nil
+
+	case compressionBzip2:
+		return bzip2.NewReader(reader), noop, nil
+
+	case compressionXz:
+		xzStream, err := xz.NewReader(reader)
+		return xzStream, noop, err
+
+	case compressionZstd:
+		zstdStream, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, noop, err
+		}
+		return zstdStream, zstdStream.Close, nil
+
+	case compressionLzip:
+		return &lzipReader{reader: reader}, noop, nil
+
+	case compressionLzma:
+		lzmaStream, err := lzma.NewReader(reader)
+		return lzmaStream, noop, err
+
+	default:
+		return nil, noop, fmt.Errorf("unsupported compression %s", compression)
+	}
+}
+
+// defaultLevel asks compress for the default level of a compression format
+const defaultLevel = -1
+
+// gzipBlockSize is the size of the blocks gzip compresses in parallel, it is fixed so that the
+// output does not depend on the number of cpus
+const gzipBlockSize = 1 << 20
+
+// xzDictCaps are the dictionary sizes of the xz presets 0 to 9
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// compressionFromName infers the compression of a tarball from its file name, gzip when the
+// extension is not one of formats
+func compressionFromName(name string) string {
+	extension, compression := "", compressionGzip
+	for ext, pair := range formats {
+		if pair[1] == containerTar && strings.HasSuffix(name, "."+ext) && len(ext) > len(extension) {
+			extension, compression = ext, pair[0]
+		}
+	}
+	return compression
+}
+
+// compress wraps writer with a compressor for compression at level, 1-9 for gzip, 1-22 for zstd
+// and 0-9 for xz. Gzip and zstd compress blocks in parallel on every cpu. Closing the returned
+// writer flushes the compressor, writer is left open.
+func compress(writer io.Writer, compression string, level int) (io.WriteCloser, error) {
+	switch compression {
+	case compressionNone:
+		if level != defaultLevel {
+			return nil, fmt.Errorf("level %d given without compression", level)
+		}
+		return nopWriteCloser{writer}, nil
+
+	case compressionGzip:
+		gzipStream, err := pgzip.NewWriterLevel(writer, level)
+		if err != nil {
+			return nil, err
+		}
+		if err := gzipStream.SetConcurrency(gzipBlockSize, runtime.NumCPU()); err != nil {
+			return nil, err
+		}
+		// the header carries no name and a zero mtime
+		gzipStream.Header = pgzip.Header{OS: gzipUnknownOS}
+		return gzipStream, nil
+
+	case compressionZstd:
+		speed := zstd.SpeedDefault
+		if level != defaultLevel {
+			if level < 1 || level > 22 {
+				return nil, fmt.Errorf("zstd: invalid compression level: %d", level)
+			}
+			speed = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(writer, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(runtime.NumCPU()))
+
+	case compressionXz:
+		if level == defaultLevel {
+			level = 6
+		}
+		if level < 0 || level >= len(xzDictCaps) {
+			return nil, fmt.Errorf("xz: invalid compression level: %d", level)
+		}
+		return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(writer)
+
+	default:
+		return nil, fmt.Errorf("writing %s compressed archives is not supported", compression)
+	}
+}
+
+// nopWriteCloser is a writer with a Close method that does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// lzipReader decompresses the members of an lzip file and checks their trailers
+type lzipReader struct {
+	reader *bufio.Reader
+	member *lzma.Reader
+	crc    uint32
+	size   uint64
+}
+
+func (r *lzipReader) Read(p []byte) (int, error) {
+	for {
+		if r.member == nil {
+			if err := r.nextMember(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.member.Read(p)
+		r.crc = crc32.Update(r.crc, crc32.IEEETable, p[:n])
+		r.size += uint64(n)
+		if err == io.EOF {
+			if err := r.checkTrailer(); err != nil {
+				return n, err
+			}
+			r.member = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// nextMember reads an lzip member header and starts decoding its lzma stream, returning io.EOF
+// once there are no members left
+func (r *lzipReader) nextMember() error {
+	header := make([]byte, 6)
+	n, err := io.ReadFull(r.reader, header)
+	if n == 0 && err == io.EOF {
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+
+	if !bytes.HasPrefix(header, []byte("LZIP")) {
+		return errors.New("lzip: invalid member header")
+	}
+
+	if header[4] != 1 {
+		return fmt.Errorf("lzip: unsupported version %d", header[4])
+	}
+
+	dictSize := uint32(1) << (header[5] & 0x1f)
+	dictSize -= (dictSize / 16) * uint32((header[5]>>5)&0x07)
+
+	// lzip members are raw lzma streams using fixed properties and an end of stream marker,
+	// present them to the lzma reader with a classic header of unknown size
+	classic := make([]byte, lzma.HeaderLen)
+	classic[0] = 0x5d // lc=3, lp=0, pb=2
+	binary.LittleEndian.PutUint32(classic[1:], dictSize)
+	binary.LittleEndian.PutUint64(classic[5:], ^uint64(0))
+
+	member, err := lzma.NewReader(io.MultiReader(bytes.NewReader(classic), r.reader))
+	if err != nil {
+		return err
+	}
+
+	r.member = member
+	r.crc = 0
+	r.size = 0
+	return nil
+}
+
+func (r *lzipReader) checkTrailer() error {
+	trailer := make([]byte, 20)
+	if _, err := io.ReadFull(r.reader, trailer); err != nil {
+		return fmt.Errorf("lzip: truncated member trailer: %v", err)
+	}
+
+	if crc := binary.LittleEndian.Uint32(trailer); crc != r.crc {
+		return fmt.Errorf("lzip: crc mismatch, expected %08x, got %08x", crc, r.crc)
+	}
+
+	if size := binary.LittleEndian.Uint64(trailer[4:]); size != r.size {
+		return fmt.Errorf("lzip: size mismatch, expected %d, got %d", size, r.size)
+	}
+
+	return nil
+}
+
+// extractArchive extracts a downloaded archive into outputDir returning the first directory created
+// and every path that did not exist before extraction. The format is sniffed from the file contents
+// unless one of the names in formats is given.
+func extractArchive(f *os.File, outputDir string, format string, opts extractOptions) (string, []string, error) {
+	reader := bufio.NewReaderSize(f, 64*1024)
+
+	var compression, container string
+	if format != "" {
+		pair, ok := formats[strings.TrimPrefix(format, ".")]
+		if !ok {
+			return "", nil, fmt.Errorf("unsupported format %s", format)
+		}
+		compression, container = pair[0], pair[1]
+	} else {
+		header, _ := reader.Peek(sniffLen)
+		compression = sniffCompression(header)
+	}
+
+	stream, closer, err := decompress(reader, compression)
+	if err != nil {
+		return "", nil, err
+	}
+	defer closer()
+
+	if container == "" {
+		buffered := bufio.NewReaderSize(stream, sniffLen)
+		header, _ := buffered.Peek(sniffLen)
+		container = sniffContainer(header)
+		stream = buffered
+	}
+
+	if container == containerZip {
+		if compression == compressionNone {
+			info, err := f.Stat()
+			if err != nil {
+				return "", nil, err
+			}
+			return unZip(f, info.Size(), outputDir, opts)
+		}
+
+		// zip needs random access, spool the decompressed archive to a temporary file
+		tmp, err := ioutil.TempFile("", "espbuild-zip")
+		if err != nil {
+			return "", nil, err
+		}
+		defer func() {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}()
+
+		size, err := io.Copy(tmp, stream)
+		if err != nil {
+			return "", nil, err
+		}
+		return unZip(tmp, size, outputDir, opts)
+	}
+
+	return unTar(stream, outputDir, opts)
+}
+
+// unZip extracts a zip archive with the same semantics as unTar
+func unZip(reader io.ReaderAt, size int64, outputDir string, opts extractOptions) (string, []string, error) {
+	source := ""
+	var created []string
+
+	zr, err := zip.NewReader(reader, size)
+	if err != nil {
+		return source, created, err
+	}
+
+	for _, zf := range zr.File {
+		info := zf.FileInfo()
+
+		rc, err := zf.Open()
+		if err != nil {
+			return source, created, err
+		}
+
+		// zip stores the target of a symlink as its contents
+		linkname := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := ioutil.ReadAll(rc)
+			if err != nil {
+				_ = rc.Close()
+				return source, created, err
+			}
+			linkname = string(target)
+		}
+
+		header, err := tar.FileInfoHeader(info, linkname)
+		if err != nil {
+			_ = rc.Close()
+			return source, created, err
+		}
+		header.Name = zf.Name
+
+		target, linkTarget, err := entryTarget(header, outputDir, opts)
+		if err != nil {
+			_ = rc.Close()
+			return source, created, err
+		}
+
+		// zip files frequently omit directory entries, create missing parents the way a dir entry would
+		parents, err := mkdirParents(outputDir, target)
+		created = append(created, parents...)
+		if err != nil {
+			_ = rc.Close()
+			return source, created, err
+		}
+		if source == "" && len(parents) > 0 {
+			source = parents[0]
+		}
+
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			created = append(created, target)
+		} else if err := prepareTarget(header, target); err != nil {
+			_ = rc.Close()
+			return source, created, err
+		}
+		source, err = processTarEntry(header, rc, target, linkTarget, source)
+		if closeErr := rc.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return source, created, err
+		}
+	}
+
+	return source, created, nil
+}
+
+// mkdirParents creates the missing directories between outputDir and target, returning those it created
+func mkdirParents(outputDir string, target string) ([]string, error) {
+	// targets are joined and so cleaned, "rootfs/" would never match them
+	outputDir = filepath.Clean(outputDir)
+
+	var missing []string
+	for dir := filepath.Dir(target); dir != outputDir && strings.HasPrefix(dir, outputDir); dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		missing = append([]string{dir}, missing...)
+	}
+
+	for i, dir := range missing {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return missing[:i], err
+		}
+	}
+	return missing, nil
+}
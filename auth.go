@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// credentials holds the TLS settings and secrets used to reach servers that require authentication.
+// Secrets only ever come from ~/.netrc and the environment, recipes can not carry them.
+type credentials struct {
+	tlsConfig *tls.Config
+	netrc     []netrcMachine
+}
+
+// creds is shared by every http and git fetch, configured in main
+var creds = &credentials{}
+
+// netrcMachine is a machine or default entry of a netrc file
+type netrcMachine struct {
+	name     string
+	login    string
+	password string
+}
+
+// defaultCABundle, defaultClientCert and defaultClientKey are the environment defaults of the TLS flags
+func defaultCABundle() string {
+	return os.Getenv("ESPBUILD_CA_BUNDLE")
+}
+
+func defaultClientCert() string {
+	return os.Getenv("ESPBUILD_CLIENT_CERT")
+}
+
+func defaultClientKey() string {
+	return os.Getenv("ESPBUILD_CLIENT_KEY")
+}
+
+// netrcPath returns $NETRC or ~/.netrc
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// loadCredentials reads the netrc file and builds the TLS configuration. caBundle adds certificate
+// authorities to the system pool, clientCert and clientKey are presented to servers that ask for them.
+func loadCredentials(caBundle string, clientCert string, clientKey string) (*credentials, error) {
+	c := &credentials{tlsConfig: &tls.Config{}}
+
+	if caBundle != "" {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s contains no certificates", caBundle)
+		}
+		c.tlsConfig.RootCAs = pool
+	}
+
+	if clientCert != "" || clientKey != "" {
+		if clientKey == "" {
+			// the key is commonly kept in the same pem file as the certificate
+			clientKey = clientCert
+		}
+
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		c.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if path := netrcPath(); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		c.netrc = parseNetrc(string(data))
+	}
+
+	// git over https goes through the same proxy and TLS settings as downloads
+	client.InstallProtocol("https", githttp.NewClient(&http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c.tlsConfig,
+		},
+	}))
+
+	return c, nil
+}
+
+// parseNetrc reads the machine and default entries of a netrc file, macros are skipped
+func parseNetrc(data string) []netrcMachine {
+	var machines []netrcMachine
+	var current *netrcMachine
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			value := ""
+			if j+1 < len(fields) {
+				value = fields[j+1]
+			}
+
+			switch fields[j] {
+			case "machine":
+				machines = append(machines, netrcMachine{name: value})
+				current = &machines[len(machines)-1]
+				j++
+			case "default":
+				machines = append(machines, netrcMachine{})
+				current = &machines[len(machines)-1]
+			case "login":
+				if current != nil {
+					current.login = value
+				}
+				j++
+			case "password":
+				if current != nil {
+					current.password = value
+				}
+				j++
+			case "account":
+				j++
+			case "macdef":
+				// a macro runs until the next empty line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			}
+		}
+	}
+
+	return machines
+}
+
+// lookupNetrc returns the netrc entry for host, falling back to the default entry
+func (c *credentials) lookupNetrc(host string) *netrcMachine {
+	var fallback *netrcMachine
+	for i := range c.netrc {
+		machine := &c.netrc[i]
+		if machine.name == host {
+			return machine
+		}
+		if machine.name == "" && fallback == nil {
+			fallback = machine
+		}
+	}
+	return fallback
+}
+
+// tokenVariable returns the environment variable holding the token for host,
+// ESPBUILD_TOKEN_ARTIFACTS_EXAMPLE_COM for artifacts.example.com
+func tokenVariable(host string) string {
+	return "ESPBUILD_TOKEN_" + strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return '_'
+		}
+		return unicode.ToUpper(r)
+	}, host)
+}
+
+// authorization returns the Authorization header for a request to u, a bearer token from the
+// environment takes precedence over a netrc login. Credentials are never sent without TLS.
+func (c *credentials) authorization(u *url.URL) string {
+	if u.Scheme != "https" {
+		return ""
+	}
+
+	if token := os.Getenv(tokenVariable(u.Hostname())); token != "" {
+		return "Bearer " + token
+	}
+
+	if machine := c.lookupNetrc(u.Hostname()); machine != nil && machine.login != "" {
+		req := &http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(machine.login, machine.password)
+		return req.Header.Get("Authorization")
+	}
+
+	return ""
+}
+
+// authTransport adds credentials to every request it sends, including redirects and mirrors
+// which are authorized for their own host rather than the one the recipe named
+type authTransport struct {
+	base http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	auth := creds.authorization(req.URL)
+	if auth == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", auth)
+	return t.base.RoundTrip(req)
+}
+
+// checkHeaders refuses recipe headers that would carry credentials
+func checkHeaders(headers http.Header) error {
+	for name := range headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Proxy-Authorization", "Cookie":
+			return fmt.Errorf("%s can not be set by a recipe, use ~/.netrc or ESPBUILD_TOKEN_<HOST>", name)
+		}
+	}
+	return nil
+}
+
+// checkURL refuses urls with a password embedded in them
+func checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return nil
+	}
+
+	if _, ok := u.User.Password(); ok {
+		return fmt.Errorf("%s: credentials can not be set by a recipe, use ~/.netrc or %s", u.Host, tokenVariable(u.Hostname()))
+	}
+	return nil
+}
+
+// gitAuth returns the credentials for a git remote. SSH remotes use $ESPBUILD_GIT_SSH_KEY when it is
+// set and the ssh agent otherwise, https remotes use a token from the environment or a netrc login.
+func (c *credentials) gitAuth(remote string) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	switch endpoint.Protocol {
+	case "ssh":
+		key := os.Getenv("ESPBUILD_GIT_SSH_KEY")
+		if key == "" {
+			return nil, nil
+		}
+
+		user := endpoint.User
+		if user == "" {
+			user = "git"
+		}
+		auth, err := ssh.NewPublicKeysFromFile(user, key, os.Getenv("ESPBUILD_GIT_SSH_PASSPHRASE"))
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", key, err)
+		}
+		return auth, nil
+
+	case "https":
+		// forges accept an access token as the password of any user name
+		if token := os.Getenv(tokenVariable(endpoint.Host)); token != "" {
+			return &githttp.BasicAuth{Username: "git", Password: token}, nil
+		}
+
+		if machine := c.lookupNetrc(endpoint.Host); machine != nil && machine.login != "" {
+			return &githttp.BasicAuth{Username: machine.login, Password: machine.password}, nil
+		}
+	}
+
+	return nil, nil
+}
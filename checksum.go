@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"io"
+	"strings"
+)
+
+// checksum is an expected digest along with the running hash used to verify it
+type checksum struct {
+	algorithm string
+	expected  string
+	hash      hash.Hash
+}
+
+func newChecksum(algorithm string, expected string) (*checksum, error) {
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	case "blake2b":
+		// blake2b-512 matches the output of b2sum
+		h, _ = blake2b.New512(nil)
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %s", algorithm)
+	}
+
+	expected = strings.ToLower(strings.TrimSpace(expected))
+	if _, err := hex.DecodeString(expected); err != nil || len(expected) != h.Size()*2 {
+		return nil, fmt.Errorf("invalid %s checksum %q", algorithm, expected)
+	}
+
+	return &checksum{algorithm: algorithm, expected: expected, hash: h}, nil
+}
+
+// newChecksums returns a checksum for every non empty digest passed to fetch
+func newChecksums(sha256sum string, sha512sum string, blake2bsum string) ([]*checksum, error) {
+	var checksums []*checksum
+	for _, c := range []struct{ algorithm, expected string }{
+		{"sha256", sha256sum},
+		{"sha512", sha512sum},
+		{"blake2b", blake2bsum},
+	} {
+		if c.expected == "" {
+			continue
+		}
+
+		sum, err := newChecksum(c.algorithm, c.expected)
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, sum)
+	}
+
+	return checksums, nil
+}
+
+// checksumWriter returns a writer that feeds every checksum
+func checksumWriter(checksums []*checksum) io.Writer {
+	writers := make([]io.Writer, len(checksums))
+	for i, c := range checksums {
+		writers[i] = c.hash
+	}
+	return io.MultiWriter(writers...)
+}
+
+// resetChecksums discards anything hashed so far, ready for another attempt at a download
+func resetChecksums(checksums []*checksum) {
+	for _, c := range checksums {
+		c.hash.Reset()
+	}
+}
+
+// checksumError is returned when downloaded content does not match its expected digest
+type checksumError struct {
+	url       string
+	algorithm string
+	expected  string
+	actual    string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch for %s: expected %s, got %s", e.algorithm, e.url, e.expected, e.actual)
+}
+
+// verifyChecksums returns an error describing the first checksum that does not match
+func verifyChecksums(url string, checksums []*checksum) error {
+	for _, c := range checksums {
+		actual := hex.EncodeToString(c.hash.Sum(nil))
+		if actual != c.expected {
+			return &checksumError{url: url, algorithm: c.algorithm, expected: c.expected, actual: actual}
+		}
+	}
+	return nil
+}
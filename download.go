@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloads is the download cache shared by every fetch, configured in main
+var downloads *downloadCache
+
+// offline restricts every fetch to the download cache, configured in main
+var offline bool
+
+// offlineError is returned when an offline fetch needs something that is not in the download cache
+type offlineError struct {
+	recipe string
+	url    string
+}
+
+func (e *offlineError) Error() string {
+	if e.recipe == "" {
+		return "offline: " + e.url + " is not in the download cache"
+	}
+	return "offline: " + e.recipe + " needs " + e.url + " which is not in the download cache"
+}
+
+// downloadCache is an on disk, content addressed store of downloaded files.
+//
+// Layout:
+//
+//	blobs/sha256/<digest>   downloaded bytes named by their sha256
+//	urls/<sha256 of url>    json cacheEntry describing the last download of a url
+//	tmp/                    in progress and interrupted downloads
+type downloadCache struct {
+	dir string
+
+	locksMu sync.Mutex
+	locks   map[string]*sync.Mutex
+	// fetched holds the entries downloaded or revalidated by this run, guarded by locksMu
+	fetched map[string]*cacheEntry
+}
+
+// cacheEntry records what was downloaded from a url and how to revalidate it. The validators belong
+// to the server of Origin, the mirror that was asked, and are only sent back to it.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	Origin       string `json:"origin,omitempty"`
+	FinalURL     string `json:"final_url,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+}
+
+// defaultCacheDir returns $ESPBUILD_CACHE, falling back to the users cache directory
+func defaultCacheDir() string {
+	if dir := os.Getenv("ESPBUILD_CACHE"); dir != "" {
+		return dir
+	}
+
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "espbuild")
+	}
+
+	return filepath.Join(os.TempDir(), "espbuild-cache")
+}
+
+func newDownloadCache(dir string) (*downloadCache, error) {
+	for _, d := range []string{"blobs/sha256", "urls", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &downloadCache{dir: dir, locks: make(map[string]*sync.Mutex), fetched: make(map[string]*cacheEntry)}, nil
+}
+
+func (c *downloadCache) blobPath(sum string) string {
+	return filepath.Join(c.dir, "blobs", "sha256", sum)
+}
+
+func (c *downloadCache) entryPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, "urls", hex.EncodeToString(sum[:]))
+}
+
+// lookup returns the cache entry for url, or nil if it is unknown or its blob is missing
+func (c *downloadCache) lookup(url string) *cacheEntry {
+	data, err := ioutil.ReadFile(c.entryPath(url))
+	if err != nil {
+		return nil
+	}
+
+	entry := new(cacheEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		warn("ignoring corrupt cache entry for " + url + ": " + err.Error())
+		return nil
+	}
+
+	if _, err := os.Stat(c.blobPath(entry.SHA256)); err != nil {
+		return nil
+	}
+
+	return entry
+}
+
+func (c *downloadCache) store(entry *cacheEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(c.dir, "tmp"), "entry")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.entryPath(entry.URL))
+}
+
+// expectedSHA256 returns the sha256 a fetch was pinned to, if any
+func expectedSHA256(checksums []*checksum) string {
+	for _, c := range checksums {
+		if c.algorithm == "sha256" {
+			return c.expected
+		}
+	}
+	return ""
+}
+
+// verifyBlob hashes an already cached blob against the requested checksums
+func (c *downloadCache) verifyBlob(url string, entry *cacheEntry, checksums []*checksum) error {
+	if len(checksums) == 0 {
+		return nil
+	}
+	resetChecksums(checksums)
+
+	f, err := os.Open(c.blobPath(entry.SHA256))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(checksumWriter(checksums), f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return verifyChecksums(url, checksums)
+}
+
+// newHttpClient returns a client without an overall deadline, downloads are bounded by idleReader instead
+func newHttpClient(timeout time.Duration) *http.Client {
+	var netTransport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       creds.tlsConfig,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: timeout,
+	}
+
+	// Disable automagic decompression, files are cached exactly as served
+	netTransport.DisableCompression = true
+
+	return &http.Client{
+		Transport: &authTransport{base: netTransport},
+	}
+}
+
+// idleReader cancels a request once no data has been read for timeout
+type idleReader struct {
+	reader  io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleReader(reader io.Reader, timeout time.Duration, cancel context.CancelFunc) *idleReader {
+	return &idleReader{reader: reader, timeout: timeout, timer: time.AfterFunc(timeout, cancel)}
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+func (r *idleReader) stop() {
+	r.timer.Stop()
+}
+
+// retries is the number of times a url is retried before moving on to the next mirror
+const retries = 3
+
+// retryDelay is the delay before the first retry, doubling on every further attempt
+const retryDelay = time.Second
+
+// statusError is returned for http responses that did not deliver the requested file
+type statusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status " + e.status + " fetching " + e.url
+}
+
+// retryable reports whether a failed download is worth attempting again from the same url
+func retryable(err error) bool {
+	var checksumErr *checksumError
+	if errors.As(err, &checksumErr) {
+		return false
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusRequestedRangeNotSatisfiable:
+			return true
+		}
+		return statusErr.code >= 500
+	}
+
+	// anything else is a transport level failure
+	return true
+}
+
+// fetch returns the cache entry for urls, downloading it if the cached copy is missing or stale.
+// The first url is the canonical name the download is cached under, the rest and any configured
+// mirrors are tried in turn if it can not be fetched. Downloaded bytes are verified against
+// checksums before they are added to the cache. headers are sent with every request.
+func (c *downloadCache) fetch(urls []string, timeout time.Duration, checksums []*checksum, headers http.Header) (*cacheEntry, error) {
+	key := urls[0]
+
+	// a pinned sha256 that is already present needs no network access at all
+	if sum := expectedSHA256(checksums); sum != "" {
+		if info, err := os.Stat(c.blobPath(sum)); err == nil {
+			entry := c.lookup(key)
+			if entry == nil || entry.SHA256 != sum {
+				entry = &cacheEntry{URL: key, SHA256: sum, Size: info.Size()}
+			}
+			if err := c.verifyBlob(key, entry, checksums); err == nil {
+				debug("cache hit for " + key)
+				return entry, nil
+			}
+		}
+	}
+
+	// looked up only once the lock is held, a fetch of the same key may just have finished
+	c.lock(key)
+	defer c.unlock(key)
+
+	if entry := c.fetchedEntry(key); entry != nil {
+		debug("already fetched " + key)
+		return entry, c.verifyBlob(key, entry, checksums)
+	}
+
+	cached := c.lookup(key)
+	if offline {
+		if cached == nil {
+			return nil, &offlineError{url: key}
+		}
+		return cached, c.verifyBlob(key, cached, checksums)
+	}
+
+	var failures []string
+	for _, url := range mirrored(urls) {
+		delay := retryDelay
+		for attempt := 1; ; attempt++ {
+			entry, err := c.download(key, url, cached, timeout, checksums, headers)
+			if err == nil {
+				c.locksMu.Lock()
+				c.fetched[key] = entry
+				c.locksMu.Unlock()
+				return entry, nil
+			}
+
+			if !retryable(err) || attempt == retries {
+				failures = append(failures, err.Error())
+				break
+			}
+
+			warn(fmt.Sprintf("%v, retrying in %v", err, delay))
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return nil, fmt.Errorf("unable to fetch %s: %s", key, strings.Join(failures, "; "))
+}
+
+// partialEntry records where a .partial download came from so it is only resumed against the same content
+type partialEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// partialPath returns the path an interrupted download of key is kept at between attempts and runs
+func (c *downloadCache) partialPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, "tmp", hex.EncodeToString(sum[:])+".partial")
+}
+
+// resumeFrom returns the number of bytes already downloaded for key from url along with the validator
+// used to make sure the remaining bytes belong to the same file. Validators are per server, a
+// partial download from another mirror is started over.
+func (c *downloadCache) resumeFrom(key string, url string) (int64, string) {
+	partial := c.partialPath(key)
+	info, err := os.Stat(partial)
+	if err != nil || info.Size() == 0 {
+		return 0, ""
+	}
+
+	data, err := ioutil.ReadFile(partial + ".json")
+	if err != nil {
+		return 0, ""
+	}
+
+	var meta partialEntry
+	if err := json.Unmarshal(data, &meta); err != nil || meta.URL != url {
+		return 0, ""
+	}
+
+	// a weak etag can not be used with If-Range
+	if meta.ETag != "" && !strings.HasPrefix(meta.ETag, "W/") {
+		return info.Size(), meta.ETag
+	} else if meta.LastModified != "" {
+		return info.Size(), meta.LastModified
+	}
+
+	return 0, ""
+}
+
+func (c *downloadCache) removePartial(key string) {
+	partial := c.partialPath(key)
+	for _, path := range []string{partial, partial + ".json"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			warn(err.Error())
+		}
+	}
+}
+
+// download fetches url once, revalidating cached if it is present, and records the result under key.
+// Bytes are written to a .partial file that later attempts resume with a Range request. Callers
+// must hold the lock of key.
+func (c *downloadCache) download(key string, url string, cached *cacheEntry, timeout time.Duration, checksums []*checksum, headers http.Header) (*cacheEntry, error) {
+	resetChecksums(checksums)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	for name, values := range headers {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+
+	offset, validator := c.resumeFrom(key, url)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	} else if cached != nil && cached.Origin == url {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	release := downloadSlots.acquire(req.URL.Host)
+	defer release()
+
+	resp, err := newHttpClient(timeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			warn(err.Error())
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil && cached.Origin == url {
+		debug("revalidated cache entry for " + url)
+		return cached, c.verifyBlob(url, cached, checksums)
+	}
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the partial file no longer matches what the server has, start over on the next attempt
+		c.removePartial(key)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &statusError{url: url, status: resp.Status, code: resp.StatusCode}
+	}
+
+	partial := c.partialPath(key)
+	flags := os.O_CREATE | os.O_RDWR
+	if resp.StatusCode == http.StatusPartialContent {
+		if start := contentRangeStart(resp.Header.Get("Content-Range")); start != offset {
+			c.removePartial(key)
+			return nil, fmt.Errorf("server resumed %s at byte %d, expected %d", url, start, offset)
+		}
+		debug(fmt.Sprintf("resuming %s at byte %d", url, offset))
+	} else {
+		offset = 0
+		flags |= os.O_TRUNC
+
+		meta, err := json.Marshal(&partialEntry{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ioutil.WriteFile(partial+".json", meta, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// hash what was downloaded by earlier attempts before appending to it
+	sum := sha256.New()
+	hashes := io.MultiWriter(sum, checksumWriter(checksums))
+	if _, err := io.CopyN(hashes, out, offset); err != nil {
+		_ = out.Close()
+		c.removePartial(key)
+		return nil, err
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	status := progress.start(path.Base(resp.Request.URL.Path), offset, total)
+
+	body := newIdleReader(resp.Body, timeout, cancel)
+	size, err := io.Copy(out, io.TeeReader(body, io.MultiWriter(hashes, status)))
+	body.stop()
+	progress.finish(status, err)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("no data received from %s for %v", url, timeout)
+		}
+		return nil, fmt.Errorf("downloading %s: %w", url, err)
+	}
+
+	if err := verifyChecksums(url, checksums); err != nil {
+		c.removePartial(key)
+		return nil, err
+	}
+
+	entry := &cacheEntry{
+		URL:          key,
+		Origin:       url,
+		FinalURL:     resp.Request.URL.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		SHA256:       hex.EncodeToString(sum.Sum(nil)),
+		Size:         offset + size,
+	}
+
+	if err := os.Rename(partial, c.blobPath(entry.SHA256)); err != nil {
+		return nil, err
+	}
+	c.removePartial(key)
+
+	return entry, c.store(entry)
+}
+
+// contentRangeStart returns the first byte position of a "bytes start-end/size" Content-Range, or -1
+func contentRangeStart(contentRange string) int64 {
+	var start, end int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &start, &end); err != nil {
+		return -1
+	}
+	return start
+}
+
+// lock serialises fetches of the same key, they share a cache entry and a .partial file
+func (c *downloadCache) lock(key string) {
+	c.locksMu.Lock()
+	l, ok := c.locks[key]
+	if !ok {
+		l = new(sync.Mutex)
+		c.locks[key] = l
+	}
+	c.locksMu.Unlock()
+	l.Lock()
+}
+
+func (c *downloadCache) unlock(key string) {
+	c.locksMu.Lock()
+	l := c.locks[key]
+	c.locksMu.Unlock()
+	l.Unlock()
+}
+
+// fetchedEntry returns the entry of key if this run already downloaded or revalidated it
+func (c *downloadCache) fetchedEntry(key string) *cacheEntry {
+	c.locksMu.Lock()
+	defer c.locksMu.Unlock()
+	return c.fetched[key]
+}
+
+// open returns a reader for the cached bytes of entry
+func (c *downloadCache) open(entry *cacheEntry) (*os.File, error) {
+	return os.Open(c.blobPath(entry.SHA256))
+}
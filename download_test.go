@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidatorsOnlySentToTheirMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	primaryUp := true
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !primaryUp {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"primary"`)
+		_, _ = w.Write([]byte("release\n"))
+	}))
+	defer primary.Close()
+
+	var mirrorValidator string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorValidator = r.Header.Get("If-None-Match")
+		// a mirror that took a foreign etag for its own would answer 304 here
+		if mirrorValidator != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"mirror"`)
+		_, _ = w.Write([]byte("release\n"))
+	}))
+	defer mirror.Close()
+
+	urls := []string{primary.URL + "/release.tar", mirror.URL + "/release.tar"}
+
+	cache, err := newDownloadCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := cache.fetch(urls, time.Minute, nil, nil)
+	if err != nil {
+		t.Fatalf("fetch() = %v", err)
+	}
+	if entry.Origin != urls[0] || entry.ETag != `"primary"` {
+		t.Fatalf("fetch() = %+v, want the etag of the primary url", entry)
+	}
+
+	// a later run finds the primary gone and falls back to the mirror
+	primaryUp = false
+	cache, err = newDownloadCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err = cache.fetch(urls, time.Minute, nil, nil)
+	if err != nil {
+		t.Fatalf("fetch() from the mirror = %v", err)
+	}
+	if mirrorValidator != "" {
+		t.Errorf("mirror was sent If-None-Match %s", mirrorValidator)
+	}
+	if entry.Origin != urls[1] || entry.ETag != `"mirror"` {
+		t.Errorf("fetch() from the mirror = %+v, want the etag of the mirror", entry)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"github.com/esplinux/espbuild/pkginfo"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// soPrefix marks depends and provides entries that name shared libraries rather than packages
+const soPrefix = "so:"
+
+// elfInfo is the dynamic linking information of an ELF binary
+type elfInfo struct {
+	needed []string
+	soname string
+	// rpath holds the RPATH and RUNPATH directories, the loader does not search the package for either
+	rpath  []string
+	interp string
+}
+
+// readELF returns the dynamic linking information of file, or nil when it is not an ELF binary
+func readELF(file string) (*elfInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != elf.ELFMAG {
+		return nil, nil
+	}
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		// not every file starting with the magic is a binary worth failing the build over
+		warn(fmt.Sprintf("skipping %s: %v", file, err))
+		return nil, nil
+	}
+
+	info := &elfInfo{}
+	for _, prog := range ef.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data, err := ioutil.ReadAll(prog.Open())
+			if err != nil {
+				return nil, fmt.Errorf("%s: reading interpreter: %w", file, err)
+			}
+			info.interp = string(bytes.TrimRight(data, "\x00"))
+		}
+	}
+
+	// static binaries have no dynamic section
+	if ef.Section(".dynamic") == nil {
+		return info, nil
+	}
+
+	if info.needed, err = ef.ImportedLibraries(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	sonames, err := ef.DynString(elf.DT_SONAME)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(sonames) > 0 {
+		info.soname = sonames[0]
+	}
+
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		paths, err := ef.DynString(tag)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for _, p := range paths {
+			info.rpath = append(info.rpath, filepath.SplitList(p)...)
+		}
+	}
+
+	return info, nil
+}
+
+// elfDependencies are the shared library dependencies of the entries of a package
+type elfDependencies struct {
+	// depends and provides are so: entries for the package metadata
+	depends  []string
+	provides []string
+	// neededBy maps each library the package depends on to the entries that need it
+	neededBy map[string][]string
+}
+
+// scanELF reads every ELF binary among entries. Libraries the package provides itself, by soname or
+// through an RPATH or RUNPATH pointing inside the package, are not dependencies. Interpreters
+// are depended on and provided by their file name.
+func scanELF(entries []tarEntry) (*elfDependencies, error) {
+	names := make(map[string]bool)
+	binaries := make(map[string]*elfInfo)
+	var order []string
+
+	for _, entry := range entries {
+		names[entry.header.Name] = true
+		if entry.header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		info, err := readELF(entry.file)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			binaries[entry.header.Name] = info
+			order = append(order, entry.header.Name)
+		}
+	}
+
+	deps := &elfDependencies{neededBy: make(map[string][]string)}
+
+	provided := make(map[string]bool)
+	provide := func(lib string) {
+		if !provided[lib] {
+			provided[lib] = true
+			deps.provides = append(deps.provides, soPrefix+lib)
+		}
+	}
+
+	for _, name := range order {
+		if soname := binaries[name].soname; soname != "" {
+			provide(soname)
+		}
+	}
+
+	// loaders have no soname, musl's is even a symlink to libc.so. They are provided by file name.
+	for _, entry := range entries {
+		name := entry.header.Name
+		if isLoader(name) && (entry.header.Typeflag == tar.TypeSymlink || binaries[name] != nil) {
+			provide(path.Base(name))
+		}
+	}
+
+	for _, name := range order {
+		info := binaries[name]
+
+		needed := info.needed
+		if info.interp != "" {
+			if names[strings.TrimPrefix(info.interp, "/")] {
+				// the package ships its own loader
+				provide(path.Base(info.interp))
+			}
+			needed = append([]string{path.Base(info.interp)}, needed...)
+		}
+
+		for _, lib := range needed {
+			if provided[lib] || inRPath(lib, name, info.rpath, names) {
+				continue
+			}
+			if len(deps.neededBy[lib]) == 0 {
+				deps.depends = append(deps.depends, soPrefix+lib)
+			}
+			deps.neededBy[lib] = append(deps.neededBy[lib], name)
+		}
+	}
+
+	sort.Strings(deps.depends)
+	sort.Strings(deps.provides)
+	return deps, nil
+}
+
+// isLoader reports whether the archive name is a dynamic loader like lib/ld-musl-x86_64.so.1 or
+// lib64/ld-linux-x86-64.so.2
+func isLoader(name string) bool {
+	matched, _ := path.Match("ld-*.so*", path.Base(name))
+	dir := path.Base(path.Dir(name))
+	return matched && (dir == "lib" || dir == "lib64")
+}
+
+// inRPath reports whether the library lib needed by the entry name is found in the package through
+// one of the rpath directories, $ORIGIN being the directory of name
+func inRPath(lib string, name string, rpath []string, names map[string]bool) bool {
+	for _, dir := range rpath {
+		for _, origin := range []string{"$ORIGIN", "${ORIGIN}"} {
+			dir = strings.Replace(dir, origin, "/"+path.Dir(name), -1)
+		}
+		if names[strings.TrimPrefix(path.Join(dir, lib), "/")] {
+			return true
+		}
+	}
+	return false
+}
+
+// installedProvides maps the libraries provided by installed packages to the package providing
+// them. Packages are given as package files or directories of them.
+func installedProvides(packages []string) (map[string]string, error) {
+	var files []string
+	for _, p := range packages {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+
+		infos, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			for _, ext := range []string{".tgz", ".tar", ".tar.gz", ".tar.xz", ".tar.zst"} {
+				if strings.HasSuffix(info.Name(), ext) {
+					files = append(files, filepath.Join(p, info.Name()))
+					break
+				}
+			}
+		}
+	}
+
+	provides := make(map[string]string)
+	for _, file := range files {
+		info, err := pkginfo.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, lib := range info.Provides {
+			if strings.HasPrefix(lib, soPrefix) {
+				provides[strings.TrimPrefix(lib, soPrefix)] = info.Name
+			}
+		}
+	}
+	return provides, nil
+}
+
+// reportMissing warns about every library of deps no installed package provides
+func reportMissing(pkg string, deps *elfDependencies, installed map[string]string) {
+	var missing []string
+	for lib := range deps.neededBy {
+		if _, ok := installed[lib]; !ok {
+			missing = append(missing, lib)
+		}
+	}
+	sort.Strings(missing)
+
+	for _, lib := range missing {
+		warn(fmt.Sprintf("%s: %s needed by %s is not provided by any installed package", pkg, lib, strings.Join(deps.neededBy[lib], ", ")))
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/containers/buildah"
 	"github.com/containers/storage/pkg/unshare"
@@ -10,6 +11,7 @@ import (
 	"go.starlark.net/starlarkstruct"
 	"go/build"
 	"log"
+	nethttp "net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -35,9 +37,14 @@ func getContainer(b *starlark.Builtin) *container {
 func containerAdd(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	debug("invoking container.add " + thread.Name + " on " + b.Name())
 
-	var file string
+	var fileArg starlark.Value
 	dest := "/"
-	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "file", &file, "dest?", &dest); err != nil {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "file", &fileArg, "dest?", &dest); err != nil {
+		return nil, err
+	}
+
+	file, err := pathString(b.Name(), "file", fileArg)
+	if err != nil {
 		return nil, err
 	}
 
@@ -110,24 +117,143 @@ func containerBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlar
 func fetchBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	debug("invoking fetch " + thread.Name)
 
+	result, err := fetch(thread, b, args, kwargs)
+
+	// name the recipe that needs a missing download, offline builds fail long before anyone reads the log
+	var offlineErr *offlineError
+	if errors.As(err, &offlineErr) {
+		offlineErr.recipe = thread.Name
+	}
+
+	return result, err
+}
+
+func fetch(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	buildfile, err := filepath.Abs(thread.Name)
 	if err != nil {
 		return starlark.None, err
 	}
 	curdir := filepath.Dir(buildfile)
 
-	var http, git, branch, file string
-	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "http?", &http, "file?", &file, "git?", &git, "branch?", &branch); err != nil {
+	var http, git, file, format, sha256, sha512, blake2b string
+	var urlList = &starlark.List{}
+	var ref gitRef
+	var sigArg, keyringArg starlark.Value
+	var headerDict = &starlark.Dict{}
+	// sources are extracted without their extended attributes, labels and capabilities of upstream
+	// tarballs mean nothing to the build and only installed packages restore them
+	var opts = extractOptions{xattrNamespaces: nil}
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "http?", &http, "urls?", &urlList, "file?", &file, "format?", &format,
+		"git?", &git, "branch?", &ref.branch, "tag?", &ref.tag, "commit?", &ref.commit, "depth?", &ref.depth, "submodules?", &ref.submodules,
+		"sha256?", &sha256, "sha512?", &sha512, "blake2b?", &blake2b, "signature?", &sigArg, "keyring?", &keyringArg,
+		"headers?", &headerDict, "absolute_symlinks?", &opts.absoluteSymlinks); err != nil {
+		return starlark.None, err
+	}
+
+	headers := make(nethttp.Header)
+	for _, item := range headerDict.Items() {
+		name, ok := starlark.AsString(item[0])
+		value, ok2 := starlark.AsString(item[1])
+		if !ok || !ok2 {
+			return starlark.None, fmt.Errorf("fetch: headers must map strings to strings, got %s: %s", item[0].Type(), item[1].Type())
+		}
+		headers.Add(name, value)
+	}
+
+	if err := checkHeaders(headers); err != nil {
 		return starlark.None, err
 	}
 
+	var sig *signature
+	if sigArg != nil || keyringArg != nil {
+		if sigArg == nil || keyringArg == nil {
+			return starlark.None, errors.New("fetch: signature and keyring must be given together")
+		}
+
+		sig = &signature{}
+		if sig.location, err = pathString(b.Name(), "signature", sigArg); err != nil {
+			return starlark.None, err
+		}
+		if sig.keyring, err = pathString(b.Name(), "keyring", keyringArg); err != nil {
+			return starlark.None, err
+		}
+
+		// files shipped with the recipe are found next to it wherever espbuild is run from
+		if !strings.Contains(sig.location, "://") && !filepath.IsAbs(sig.location) {
+			sig.location = filepath.Join(curdir, sig.location)
+		}
+		if !filepath.IsAbs(sig.keyring) {
+			sig.keyring = filepath.Join(curdir, sig.keyring)
+		}
+	}
+
+	var urls []string
 	if http != "" {
+		urls = append(urls, http)
+	}
+
+	iter := urlList.Iterate()
+	defer iter.Done()
+	var k starlark.Value
+	for iter.Next(&k) {
+		url, ok := starlark.AsString(k)
+		if !ok {
+			return starlark.None, fmt.Errorf("fetch: urls must be strings, got %s", k.Type())
+		}
+		urls = append(urls, url)
+	}
+
+	for _, url := range append(urls, git) {
+		if err := checkURL(url); err != nil {
+			return starlark.None, err
+		}
+	}
+
+	checksums, err := newChecksums(sha256, sha512, blake2b)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	if len(urls) > 0 {
+		checksums, err = lockHttp(curdir, urls[0], checksums)
+		if err != nil {
+			return starlark.None, err
+		}
+
+		var result starlark.Value
 		if file != "" {
-			return getHttpFile(http, curdir, file)
+			result, err = getHttpFile(urls, curdir, file, checksums, headers, sig)
+		} else {
+			result, err = getHttpSource(urls, curdir, format, opts, checksums, headers, sig)
+		}
+		if err != nil {
+			return starlark.None, err
 		}
-		return getHttpSource(http, curdir)
+		return result, recordHttp(curdir, urls[0], result.(*fetchResult))
 	} else if git != "" {
-		return getGit(git, branch, curdir)
+		if len(checksums) > 0 {
+			return starlark.None, errors.New("checksums are only supported for http sources")
+		}
+
+		if sig != nil {
+			return starlark.None, errors.New("signatures are only supported for http sources")
+		}
+
+		if len(headers) > 0 {
+			return starlark.None, errors.New("headers are only supported for http sources")
+		}
+
+		key := gitLockKey(git, &ref)
+		locked, err := lockGit(curdir, git, &ref)
+		if err != nil {
+			return starlark.None, err
+		}
+
+		result, err := getGit(git, &ref, curdir)
+		if err != nil {
+			return starlark.None, err
+		}
+		return result, recordGit(curdir, git, key, locked, result.(*fetchResult))
 	} else {
 		return starlark.None, errors.New("source only supports git and http")
 	}
@@ -136,8 +262,13 @@ func fetchBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tu
 func findBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	debug("invoking find " + thread.Name)
 
-	var glob string
-	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "glob", &glob); err != nil {
+	var globArg starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "glob", &globArg); err != nil {
+		return nil, err
+	}
+
+	glob, err := pathString(b.Name(), "glob", globArg)
+	if err != nil {
 		return nil, err
 	}
 
@@ -163,8 +294,13 @@ func findBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tup
 func isDirBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	debug("invoking isDir " + thread.Name)
 
-	var file string
-	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "file", &file); err != nil {
+	var fileArg starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "file", &fileArg); err != nil {
+		return nil, err
+	}
+
+	file, err := pathString(b.Name(), "file", fileArg)
+	if err != nil {
 		return nil, err
 	}
 
@@ -180,8 +316,13 @@ func isDirBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tu
 func lstatBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	debug("invoking lstat " + thread.Name)
 
-	var file string
-	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "file", &file); err != nil {
+	var fileArg starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "file", &fileArg); err != nil {
+		return nil, err
+	}
+
+	file, err := pathString(b.Name(), "file", fileArg)
+	if err != nil {
 		return nil, err
 	}
 
@@ -211,6 +352,103 @@ func matchBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tu
 	return starlark.Bool(matched), err
 }
 
+func patchBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	debug("invoking patch " + thread.Name)
+
+	var sourceArg starlark.Value
+	var patchList = &starlark.List{}
+	strip := 1
+	fuzz := 0
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "source", &sourceArg, "patches", &patchList, "strip?", &strip, "fuzz?", &fuzz); err != nil {
+		return starlark.None, err
+	}
+
+	source, err := pathString(b.Name(), "source", sourceArg)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	if strip < 0 || fuzz < 0 {
+		return starlark.None, fmt.Errorf("%s: strip and fuzz must not be negative", b.Name())
+	}
+
+	var patches []string
+	for i := 0; i < patchList.Len(); i++ {
+		patch, err := pathString(b.Name(), "patches", patchList.Index(i))
+		if err != nil {
+			return starlark.None, err
+		}
+		patches = append(patches, patch)
+	}
+
+	// the source is returned as given so fetch results keep their details
+	return sourceArg, Patch(source, patches, strip, fuzz)
+}
+
+func partitionBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	debug("invoking partition " + thread.Name)
+
+	var baseDirArg starlark.Value
+	var packages *starlark.Dict
+	var mainPkg string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "basedir", &baseDirArg, "packages", &packages, "main", &mainPkg); err != nil {
+		return starlark.None, err
+	}
+
+	baseDir, err := pathString(b.Name(), "basedir", baseDirArg)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	var pkgs []string
+	var globs [][]string
+	for _, item := range packages.Items() {
+		pkg, ok := starlark.AsString(item[0])
+		list, ok2 := item[1].(*starlark.List)
+		if !ok || !ok2 {
+			return starlark.None, fmt.Errorf("%s: packages must map names to lists of globs, got %s: %s", b.Name(), item[0].Type(), item[1].Type())
+		}
+
+		pkgGlobs, err := stringList(b.Name(), "packages", list)
+		if err != nil {
+			return starlark.None, err
+		}
+		pkgs = append(pkgs, pkg)
+		globs = append(globs, pkgGlobs)
+	}
+
+	rules, err := newSplitRules(pkgs, globs)
+	if err != nil {
+		return starlark.None, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+
+	partitioned, err := partition(baseDir, rules, mainPkg)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	// main first, then the packages in the order they were given
+	result := &starlark.Dict{}
+	for _, pkg := range append([]string{mainPkg}, pkgs...) {
+		files, ok := partitioned[pkg]
+		if !ok {
+			continue
+		}
+		if _, found, _ := result.Get(starlark.String(pkg)); found {
+			continue
+		}
+
+		values := make([]starlark.Value, len(files))
+		for i, file := range files {
+			values[i] = starlark.String(file)
+		}
+		if err := result.SetKey(starlark.String(pkg), starlark.NewList(values)); err != nil {
+			return starlark.None, err
+		}
+	}
+	return result, nil
+}
+
 func pathBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	debug("invoking path " + thread.Name)
 
@@ -243,12 +481,192 @@ func shellBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tu
 func tarBuiltIn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	debug("invoking tar " + thread.Name)
 
-	var name, baseDir string
-	var files = &starlark.List{}
-	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "basedir", &baseDir, "files", &files); err != nil {
+	var name string
+	var baseDirArg starlark.Value
+	var files starlark.Value = starlark.None
+	var include, exclude = &starlark.List{}, &starlark.List{}
+	var includeNames, excludeNames = &starlark.List{}, &starlark.List{}
+	var includeRegex, excludeRegex string
+	var idMap = &starlark.Dict{}
+	var xattrs starlark.Value = starlark.None
+	var capabilities = &starlark.Dict{}
+	var ownerSpec string
+	var owners = &starlark.Dict{}
+	var devices = &starlark.Dict{}
+	var pkgInfo *starlark.Dict
+	var installed = &starlark.List{}
+	var opts = tarOptions{level: defaultLevel, xattrNamespaces: defaultXattrNamespaces}
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "basedir", &baseDirArg, "files?", &files,
+		"include?", &include, "exclude?", &exclude, "include_names?", &includeNames, "exclude_names?", &excludeNames,
+		"include_regex?", &includeRegex, "exclude_regex?", &excludeRegex,
+		"reproducible?", &opts.reproducible, "idmap?", &idMap, "compression?", &opts.compression, "level?", &opts.level,
+		"xattrs?", &xattrs, "capabilities?", &capabilities, "owner?", &ownerSpec, "owners?", &owners, "devices?", &devices,
+		"pkginfo?", &pkgInfo, "scan_elf?", &opts.scanELF, "installed?", &installed); err != nil {
+		return starlark.None, err
+	}
+
+	if opts.compression == "" {
+		opts.compression = compressionFromName(name)
+	}
+
+	baseDir, err := pathString(b.Name(), "basedir", baseDirArg)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	if opts.epoch, err = sourceDateEpoch(); err != nil {
+		return starlark.None, err
+	}
+
+	opts.idMap = make(map[int]int)
+	for _, item := range idMap.Items() {
+		from, err := starlark.AsInt32(item[0])
+		if err != nil {
+			return starlark.None, fmt.Errorf("%s: idmap must map ids to ids, got %s: %s", b.Name(), item[0].Type(), item[1].Type())
+		}
+		to, err := starlark.AsInt32(item[1])
+		if err != nil {
+			return starlark.None, fmt.Errorf("%s: idmap must map ids to ids, got %s: %s", b.Name(), item[0].Type(), item[1].Type())
+		}
+		opts.idMap[from] = to
+	}
+
+	if xattrs != starlark.None {
+		list, ok := xattrs.(*starlark.List)
+		if !ok {
+			return starlark.None, fmt.Errorf("%s: xattrs must be a list of namespaces, got %s", b.Name(), xattrs.Type())
+		}
+
+		opts.xattrNamespaces = []string{}
+		for i := 0; i < list.Len(); i++ {
+			namespace, ok := starlark.AsString(list.Index(i))
+			if !ok {
+				return starlark.None, fmt.Errorf("%s: xattrs must be a list of namespaces, got %s", b.Name(), list.Index(i).Type())
+			}
+			opts.xattrNamespaces = append(opts.xattrNamespaces, namespace)
+		}
+	}
+
+	opts.capabilities = make(map[string]string)
+	for _, item := range capabilities.Items() {
+		file, ok := starlark.AsString(item[0])
+		text, ok2 := starlark.AsString(item[1])
+		if !ok || !ok2 {
+			return starlark.None, fmt.Errorf("%s: capabilities must map files to strings, got %s: %s", b.Name(), item[0].Type(), item[1].Type())
+		}
+
+		capability, err := encodeCapabilities(text)
+		if err != nil {
+			return starlark.None, fmt.Errorf("%s: %s: %v", b.Name(), file, err)
+		}
+		opts.capabilities[cleanName(file)] = capability
+	}
+
+	if ownerSpec != "" {
+		if opts.owner, err = parseOwner(ownerSpec, baseDir); err != nil {
+			return starlark.None, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+	}
+
+	opts.owners = make(map[string]*ownership)
+	for _, item := range owners.Items() {
+		file, ok := starlark.AsString(item[0])
+		spec, ok2 := starlark.AsString(item[1])
+		if !ok || !ok2 {
+			return starlark.None, fmt.Errorf("%s: owners must map files to strings, got %s: %s", b.Name(), item[0].Type(), item[1].Type())
+		}
+
+		o, err := parseOwnership(spec, baseDir)
+		if err != nil {
+			return starlark.None, fmt.Errorf("%s: %s: %v", b.Name(), file, err)
+		}
+		opts.owners[cleanName(file)] = o
+	}
+
+	opts.devices = make(map[string]*device)
+	for _, item := range devices.Items() {
+		file, ok := starlark.AsString(item[0])
+		spec, ok2 := starlark.AsString(item[1])
+		if !ok || !ok2 {
+			return starlark.None, fmt.Errorf("%s: devices must map files to strings, got %s: %s", b.Name(), item[0].Type(), item[1].Type())
+		}
+
+		d, err := parseDevice(spec, baseDir)
+		if err != nil {
+			return starlark.None, fmt.Errorf("%s: %s: %v", b.Name(), file, err)
+		}
+		opts.devices[cleanName(file)] = d
+	}
+
+	if pkgInfo != nil {
+		if opts.pkgInfo, err = pkgInfoFromDict(b.Name(), pkgInfo); err != nil {
+			return starlark.None, err
+		}
+	}
+
+	if installed.Len() > 0 {
+		packages, err := stringList(b.Name(), "installed", installed)
+		if err != nil {
+			return starlark.None, err
+		}
+		if opts.installed, err = installedProvides(packages); err != nil {
+			return starlark.None, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+	}
+
+	includeGlobs, err := stringList(b.Name(), "include", include)
+	if err != nil {
+		return starlark.None, err
+	}
+	excludeGlobs, err := stringList(b.Name(), "exclude", exclude)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	includeList, err := stringList(b.Name(), "include_names", includeNames)
+	if err != nil {
+		return starlark.None, err
+	}
+	excludeList, err := stringList(b.Name(), "exclude_names", excludeNames)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	filter, err := newFileFilter(includeGlobs, excludeGlobs, includeList, excludeList, includeRegex, excludeRegex)
+	if err != nil {
+		return starlark.None, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+
+	// without a file list everything under basedir is a candidate
+	var paths []string
+	if files != starlark.None {
+		list, ok := files.(*starlark.List)
+		if !ok {
+			return starlark.None, fmt.Errorf("%s: for parameter files: got %s, want list", b.Name(), files.Type())
+		}
+		if paths, err = stringList(b.Name(), "files", list); err != nil {
+			return starlark.None, err
+		}
+	}
+
+	if paths, err = filter.selectFiles(baseDir, paths); err != nil {
 		return starlark.None, err
 	}
-	return Tar(name, baseDir, files)
+
+	return Tar(name, baseDir, paths, opts)
+}
+
+// stringList converts a list argument whose elements must all be strings
+func stringList(fnName string, paramName string, list *starlark.List) ([]string, error) {
+	strs := make([]string, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		s, ok := starlark.AsString(list.Index(i))
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter %s: got list of %s, want list of string", fnName, paramName, list.Index(i).Type())
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
 }
 
 func getPredeclared() starlark.StringDict {
@@ -259,6 +677,8 @@ func getPredeclared() starlark.StringDict {
 		"isDir":     starlark.NewBuiltin("isDir", isDirBuiltIn),
 		"lstat":     starlark.NewBuiltin("lstat", lstatBuiltIn),
 		"match":     starlark.NewBuiltin("match", matchBuiltIn),
+		"partition": starlark.NewBuiltin("partition", partitionBuiltIn),
+		"patch":     starlark.NewBuiltin("patch", patchBuiltIn),
 		"path":      starlark.NewBuiltin("path", pathBuiltIn),
 		"shell":     starlark.NewBuiltin("shell", shellBuiltIn),
 		"struct":    starlark.NewBuiltin("struct", starlarkstruct.Make),
@@ -343,7 +763,29 @@ func getBuiltInsPath() string {
 	return builtins
 }
 
-// todo: emolitor refactor to use flags
+// defines collects repeated -D flags, each of which sets a predeclared boolean
+type defines []string
+
+func (d *defines) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *defines) Set(value string) error {
+	*d = append(*d, value)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(flag.CommandLine.Output(), "Usage:")
+	fmt.Fprintln(flag.CommandLine.Output(), "\tespbuild [flags] package.esp...")
+	fmt.Fprintln(flag.CommandLine.Output(), "\tespbuild [flags] lock [--update] package.esp...")
+	fmt.Fprintln(flag.CommandLine.Output(), "\t\truns fetches only, shell, patch, tar and container steps are skipped")
+	fmt.Fprintln(flag.CommandLine.Output(), "\tespbuild install --root DIR [--force] package.tgz...")
+	fmt.Fprintln(flag.CommandLine.Output(), "\tespbuild remove --root DIR package...")
+	fmt.Fprintln(flag.CommandLine.Output(), "Flags:")
+	flag.PrintDefaults()
+}
+
 func main() {
 	if buildah.InitReexec() {
 		return
@@ -372,54 +814,117 @@ func main() {
 
 		println("imageID: " + imageId)
 	*/
-	// Begin actual main
-	if len(os.Args) < 2 {
-		fmt.Println("Usage:")
-		fmt.Println("\tespbuild package.esp")
-	} else {
-		builtinsPath := getBuiltInsPath()
-		predeclared := getPredeclared()
-		globals, err := starlark.ExecFile(&starlark.Thread{Name: "BuiltIns"}, builtinsPath, nil, predeclared)
-		fatal(err)
 
-		for k, v := range globals {
-			predeclared[k] = v
+	var defined defines
+	flag.Var(&defined, "D", "set the predeclared `name` to True, may be repeated")
+	cacheDir := flag.String("cache", defaultCacheDir(), "download cache `directory`, defaults to $ESPBUILD_CACHE")
+	mirrorsFile := flag.String("mirrors", defaultMirrorsFile(), "mirror configuration `file`, defaults to $ESPBUILD_MIRRORS")
+	locked := flag.Bool("locked", false, "fail any fetch that does not match "+lockFileName+" and leave it unchanged")
+	flag.BoolVar(&offline, "offline", false, "never access the network, fetch only from the download cache")
+	caBundle := flag.String("cacert", defaultCABundle(), "additional certificate authorities `file`, defaults to $ESPBUILD_CA_BUNDLE")
+	clientCert := flag.String("cert", defaultClientCert(), "client certificate `file`, defaults to $ESPBUILD_CLIENT_CERT")
+	clientKey := flag.String("key", defaultClientKey(), "client certificate key `file`, defaults to $ESPBUILD_CLIENT_KEY")
+	jobs := flag.Int("jobs", defaultJobs, "maximum number of simultaneous downloads")
+	hostJobs := flag.Int("host-jobs", defaultHostJobs, "maximum number of simultaneous downloads from one host")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if *locked {
+		locks.mode = lockFrozen
+	}
+
+	lockOnly := len(args) > 0 && args[0] == "lock"
+	if lockOnly {
+		lockFlags := flag.NewFlagSet("lock", flag.ExitOnError)
+		update := lockFlags.Bool("update", false, "re-resolve every fetch instead of keeping locked revisions")
+		if err := lockFlags.Parse(args[1:]); err != nil {
+			fatal(err)
 		}
 
-		args := os.Args[1:]
-		if os.Args[1] == "-D" {
-			if len(os.Args) < 3 {
-				log.Fatal("You must specify a parameter with -D")
-			} else {
-				predeclared[os.Args[2]] = starlark.Bool(true)
-				args = os.Args[3:]
-			}
+		if *locked {
+			log.Fatal("-locked can not be used with lock")
 		}
 
-		var buildFiles []string
-		for _, arg := range args {
-			buildFiles = append(buildFiles, arg)
-			preProcess(&buildFiles, arg)
+		if *update {
+			locks.mode = lockUpdate
 		}
+		args = lockFlags.Args()
+	}
 
-		cache := &cache{
-			cache:       make(map[string]*entry),
-			predeclared: predeclared,
-		}
+	if len(args) > 0 && (args[0] == "install" || args[0] == "remove") {
+		fatal(packageCommand(args[0], args[1:]))
+		return
+	}
 
-		ch := make(chan string)
-		for _, buildFile := range buildFiles {
-			go func(buildfile string) {
-				globals, err := cache.Load(buildfile)
-				if err != nil {
-					log.Fatal(err)
-				}
-				ch <- fmt.Sprintf("%s = %s", buildfile, globals)
-			}(buildFile)
-		}
+	if len(args) < 1 {
+		flag.Usage()
+		return
+	}
+
+	var err error
+	downloads, err = newDownloadCache(*cacheDir)
+	fatal(err)
+
+	mirrors, err = loadMirrors(*mirrorsFile)
+	fatal(err)
+
+	creds, err = loadCredentials(*caBundle, *clientCert, *clientKey)
+	fatal(err)
+
+	if *jobs < 1 || *hostJobs < 1 {
+		log.Fatal("-jobs and -host-jobs must be at least 1")
+	}
+	downloadSlots = newScheduler(*jobs, *hostJobs)
 
-		for range buildFiles {
-			<-ch
+	builtinsPath := getBuiltInsPath()
+	predeclared := getPredeclared()
+	if lockOnly {
+		skipBuildSteps(predeclared)
+	}
+	globals, err := starlark.ExecFile(&starlark.Thread{Name: "BuiltIns"}, builtinsPath, nil, predeclared)
+	fatal(err)
+
+	for k, v := range globals {
+		predeclared[k] = v
+	}
+
+	for _, name := range defined {
+		predeclared[name] = starlark.Bool(true)
+	}
+
+	var buildFiles []string
+	for _, arg := range args {
+		buildFiles = append(buildFiles, arg)
+		preProcess(&buildFiles, arg)
+	}
+
+	cache := &cache{
+		cache:       make(map[string]*entry),
+		predeclared: predeclared,
+	}
+
+	// a failing build file is reported without stopping the others
+	ch := make(chan error)
+	for _, buildFile := range buildFiles {
+		go func(buildfile string) {
+			_, err := cache.Load(buildfile)
+			ch <- err
+		}(buildFile)
+	}
+
+	failed := 0
+	for range buildFiles {
+		if err := <-ch; err != nil {
+			log.Print(err)
+			failed++
 		}
 	}
+
+	// a failed build file never reached some of its fetches, their entries are kept
+	fatal(locks.save(failed == 0))
+
+	if failed > 0 {
+		log.Fatalf("%d of %d build files failed", failed, len(buildFiles))
+	}
 }
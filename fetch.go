@@ -1,43 +1,37 @@
 package main
 
 import (
-	"compress/bzip2"
-	"compress/gzip"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/ulikunitz/xz"
+	"fmt"
 	"go.starlark.net/starlark"
 	"io"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
-// todo: emolitor add ETag/LastUpdate, etc cache support
-
-// Files have a timeout of 30 seconds
-func getHttpFile(url string, outputDir string, file string) (starlark.Value, error) {
+// Files time out after 30 seconds without receiving any data
+func getHttpFile(urls []string, outputDir string, file string, checksums []*checksum, headers http.Header, sig *signature) (starlark.Value, error) {
 	target := filepath.Join(outputDir, file)
 
-	println("\u001b[37;1mDownloading: " + url + " to " + target + "\u001b[0m")
+	progress.println("\u001b[37;1mDownloading: " + urls[0] + " to " + target + "\u001b[0m")
 
-	var netTransport = &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout: 10 * time.Second,
-		}).DialContext,
-		TLSHandshakeTimeout: 5 * time.Second,
+	entry, err := downloads.fetch(urls, time.Second*30, checksums, headers)
+	if err != nil {
+		return starlark.None, err
 	}
 
-	var netClient = &http.Client{
-		Timeout:   time.Second * 30,
-		Transport: netTransport,
+	in, err := downloads.open(entry)
+	if err != nil {
+		return starlark.None, err
 	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			warn(err.Error())
+		}
+	}()
 
-	resp, err := netClient.Get(url)
-	if err != nil {
+	if err := verifyDownload(urls[0], in, sig); err != nil {
 		return starlark.None, err
 	}
 
@@ -51,7 +45,8 @@ func getHttpFile(url string, outputDir string, file string) (starlark.Value, err
 		return starlark.None, err
 	}
 
-	if _, err := io.Copy(out, resp.Body); err != nil {
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
 		return starlark.None, err
 	}
 
@@ -59,120 +54,63 @@ func getHttpFile(url string, outputDir string, file string) (starlark.Value, err
 		return nil, err
 	}
 
-	if err := resp.Body.Close(); err != nil {
-		return nil, err
-	}
-
-	return starlark.String(target), nil
+	return newHttpResult(target, entry), nil
 }
 
-// Sources have a timeout of 300 seconds aka 5 minutes
-func getHttpSource(url string, outputDir string) (starlark.Value, error) {
-	urlSplit := strings.Split(url, "/")
-	outputFile := urlSplit[len(urlSplit)-1]
-
-	println("\u001b[37;1mDownloading: " + url + "\u001b[0m")
-
-	var netTransport = &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout: 10 * time.Second,
-		}).DialContext,
-		TLSHandshakeTimeout: 5 * time.Second,
-	}
+// Sources time out after 60 seconds without receiving any data, interrupted downloads resume on the next attempt
+func getHttpSource(urls []string, outputDir string, format string, opts extractOptions, checksums []*checksum, headers http.Header, sig *signature) (starlark.Value, error) {
+	progress.println("\u001b[37;1mDownloading: " + urls[0] + "\u001b[0m")
 
-	// Disable automagic decompression for sources
-	netTransport.DisableCompression = true
-
-	var netClient = &http.Client{
-		Timeout:   time.Second * 300,
-		Transport: netTransport,
+	entry, err := downloads.fetch(urls, time.Second*60, checksums, headers)
+	if err != nil {
+		return starlark.None, err
 	}
 
-	resp, err := netClient.Get(url)
+	body, err := downloads.open(entry)
 	if err != nil {
 		return starlark.None, err
 	}
-
 	defer func() {
-		err := resp.Body.Close()
-		if err == nil {
-			fatal(err)
+		if err := body.Close(); err != nil {
+			warn(err.Error())
 		}
 	}()
 
-	var reader io.Reader
-	if strings.HasSuffix(outputFile, "gz") {
-		gzipStream, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return starlark.None, err
-		}
+	if err := verifyDownload(urls[0], body, sig); err != nil {
+		return starlark.None, err
+	}
 
-		defer func() {
-			err := gzipStream.Close()
-			if err == nil {
-				fatal(err)
-			}
-		}()
-
-		reader = gzipStream
-	} else if strings.HasSuffix(outputFile, "bz") {
-		reader = bzip2.NewReader(resp.Body)
-	} else if strings.HasSuffix(outputFile, "xz") {
-		reader, err = xz.NewReader(resp.Body)
-		if err != nil {
-			return starlark.None, err
-		}
-	} else {
-		reader = resp.Body
+	source, created, err := extractArchive(body, outputDir, format, opts)
+	if err != nil {
+		removeCreated(created)
+		return starlark.None, fmt.Errorf("extracting %s: %w", urls[0], err)
 	}
 
-	return UnTar(reader, outputDir)
+	return newHttpResult(source, entry), nil
 }
 
-func getGit(url string, branch string, outputDir string) (starlark.Value, error) {
-	urlSplit := strings.Split(url, "/")
-	outputDir = outputDir + "/" + urlSplit[len(urlSplit)-1]
-	if branch == "" {
-		println("\u001b[37;1mCloning: " + url + "\u001b[0m")
-		outputDir = outputDir + "-HEAD"
-	} else {
-		println("\u001b[37;1mCloning[" + branch + "]: " + url + "\u001b[0m")
-		outputDir = outputDir + "-" + branch
+// verifyDownload checks the signature of a cached download, if there is one, and rewinds it for use
+func verifyDownload(url string, f *os.File, sig *signature) error {
+	if sig == nil {
+		return nil
 	}
 
-	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
-		cloneOptions := &git.CloneOptions{
-			URL: url,
-		}
-
-		if branch != "" {
-			cloneOptions.ReferenceName = plumbing.ReferenceName(branch)
-		}
-
-		if _, err := git.PlainClone(outputDir, false, cloneOptions); err != nil {
-			return starlark.None, err
-		}
-	} else {
-		repo, err := git.PlainOpen(outputDir)
-		if err != nil {
-			return starlark.None, err
-		}
-
-		workTree, err := repo.Worktree()
-		if err != nil {
-			return starlark.None, err
-		}
+	if err := sig.verify(url, f); err != nil {
+		return err
+	}
 
-		pullOptions := &git.PullOptions{RemoteName: "origin"}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
 
-		if branch != "" {
-			pullOptions.ReferenceName = plumbing.ReferenceName(branch)
-		}
+func newHttpResult(path string, entry *cacheEntry) *fetchResult {
+	return &fetchResult{
+		path:   path,
+		url:    entry.URL,
+		sha256: entry.SHA256,
+		size:   entry.Size,
+		etag:   entry.ETag,
 
-		if err := workTree.Pull(pullOptions); err != git.NoErrAlreadyUpToDate {
-			return starlark.None, err
-		}
+		finalURL: entry.FinalURL,
 	}
-
-	return starlark.String(outputDir), nil
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+	"sort"
+	"strings"
+)
+
+// fetchResult describes what fetch retrieved. It behaves like the path string fetch used to return:
+// it converts to the path with str(), concatenates with strings, supports "in" and comparisons with
+// other results by path and offers every string method, while the details of the fetch are
+// available as attributes. Starlark compares values of different types as unequal without asking
+// either of them, comparing with a string takes str() or the path attribute.
+type fetchResult struct {
+	path   string
+	url    string
+	sha256 string
+	size   int64
+	etag   string
+
+	// where the download was finally served from after mirrors and redirects
+	finalURL string
+
+	// set for git sources only
+	commit     string
+	describe   string
+	commitTime int64
+}
+
+var (
+	_ starlark.HasAttrs   = (*fetchResult)(nil)
+	_ starlark.HasBinary  = (*fetchResult)(nil)
+	_ starlark.Comparable = (*fetchResult)(nil)
+)
+
+func (r *fetchResult) String() string        { return r.path }
+func (r *fetchResult) Type() string          { return "fetch_result" }
+func (r *fetchResult) Freeze()               {}
+func (r *fetchResult) Truth() starlark.Bool  { return r.path != "" }
+func (r *fetchResult) Hash() (uint32, error) { return starlark.String(r.path).Hash() }
+
+func (r *fetchResult) fields() starlark.StringDict {
+	fields := starlark.StringDict{
+		"path": starlark.String(r.path),
+		"url":  starlark.String(r.url),
+	}
+
+	if r.commit != "" {
+		fields["commit"] = starlark.String(r.commit)
+		fields["describe"] = starlark.String(r.describe)
+		fields["commit_time"] = starlark.MakeInt64(r.commitTime)
+	} else {
+		fields["sha256"] = starlark.String(r.sha256)
+		fields["size"] = starlark.MakeInt64(r.size)
+		fields["etag"] = starlark.String(r.etag)
+	}
+
+	return fields
+}
+
+// Attr returns a field of the result, falling back to the methods of the path string
+func (r *fetchResult) Attr(name string) (starlark.Value, error) {
+	if v, ok := r.fields()[name]; ok {
+		return v, nil
+	}
+	return starlark.String(r.path).Attr(name)
+}
+
+func (r *fetchResult) AttrNames() []string {
+	names := r.fields().Keys()
+	names = append(names, starlark.String(r.path).AttrNames()...)
+	sort.Strings(names)
+	return names
+}
+
+// CompareSameType compares two results by their paths
+func (r *fetchResult) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	return starlark.String(r.path).CompareSameType(op, starlark.String(y.(*fetchResult).path), depth)
+}
+
+// Binary allows a result to be concatenated with a string on either side and to be searched with
+// "in" like its path
+func (r *fetchResult) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	s, ok := y.(starlark.String)
+	if !ok {
+		return nil, nil
+	}
+
+	switch {
+	case op == syntax.PLUS && side == starlark.Left:
+		return starlark.String(r.path) + s, nil
+	case op == syntax.PLUS:
+		return s + starlark.String(r.path), nil
+	case op == syntax.IN && side == starlark.Right:
+		return starlark.Bool(strings.Contains(r.path, string(s))), nil
+	}
+	return nil, nil
+}
+
+// pathString converts an argument that is either a string or a fetch result into a path
+func pathString(fnName string, paramName string, v starlark.Value) (string, error) {
+	switch v := v.(type) {
+	case starlark.String:
+		return string(v), nil
+	case *fetchResult:
+		return v.path, nil
+	}
+	return "", fmt.Errorf("%s: for parameter %s: got %s, want string", fnName, paramName, v.Type())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"go.starlark.net/starlark"
+	"testing"
+)
+
+func TestFetchResultBehavesLikePath(t *testing.T) {
+	predeclared := starlark.StringDict{
+		"a":       &fetchResult{path: "/cache/a.tar.gz", url: "https://example.com/a.tar.gz"},
+		"a_again": &fetchResult{path: "/cache/a.tar.gz"},
+		"b":       &fetchResult{path: "/cache/b.tar.gz"},
+	}
+
+	tests := []string{
+		`str(a) == "/cache/a.tar.gz"`,
+		`a.path == "/cache/a.tar.gz"`,
+		`a + "/src" == "/cache/a.tar.gz/src"`,
+		`"dir:" + a == "dir:/cache/a.tar.gz"`,
+		`a == a_again`,
+		`a != b`,
+		`a < b`,
+		`a in [b, a_again]`,
+		`"a.tar" in a`,
+		`"c.tar" not in a`,
+		`a.endswith(".tar.gz")`,
+		`{a: 1}[a_again] == 1`,
+	}
+
+	for _, test := range tests {
+		v, err := starlark.Eval(&starlark.Thread{Name: "test"}, "test", test, predeclared)
+		if err != nil {
+			t.Errorf("%s: %v", test, err)
+			continue
+		}
+		if v != starlark.True {
+			t.Errorf("%s = %v, want True", test, v)
+		}
+	}
+}
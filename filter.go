@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// fileFilter selects the files of an archive. Globs match whole archive names, "*" and "?" stay
+// within a path element and "**" matches any number of elements, an excluded directory excludes
+// everything in it and an included file includes the directories leading to it. Names and regexes
+// select single entries the way tarball() always has: names are exact archive names, regexes
+// match anywhere in the path under basedir as find() returns it, and every include given must
+// match.
+type fileFilter struct {
+	include      []*regexp.Regexp
+	exclude      []*regexp.Regexp
+	includeNames map[string]bool
+	excludeNames map[string]bool
+	includeRegex *regexp.Regexp
+	excludeRegex *regexp.Regexp
+}
+
+// newFileFilter compiles the include and exclude globs and regexes, empty regexes are ignored
+func newFileFilter(include []string, exclude []string, includeNames []string, excludeNames []string, includeRegex string, excludeRegex string) (*fileFilter, error) {
+	f := &fileFilter{}
+
+	for _, glob := range include {
+		re, err := globRegexp(glob)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, re)
+	}
+
+	for _, glob := range exclude {
+		re, err := globRegexp(glob)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, re)
+	}
+
+	if len(includeNames) > 0 {
+		f.includeNames = make(map[string]bool)
+		for _, name := range includeNames {
+			f.includeNames[strings.Trim(name, "/")] = true
+		}
+	}
+
+	f.excludeNames = make(map[string]bool)
+	for _, name := range excludeNames {
+		f.excludeNames[strings.Trim(name, "/")] = true
+	}
+
+	var err error
+	if includeRegex != "" {
+		if f.includeRegex, err = regexp.Compile(includeRegex); err != nil {
+			return nil, err
+		}
+	}
+
+	if excludeRegex != "" {
+		if f.excludeRegex, err = regexp.Compile(excludeRegex); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// globRegexp converts a glob to an anchored regexp
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	glob = strings.Trim(glob, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "**" && i > 0 && glob[i-1] == '/':
+			// "dir/**" also matches dir itself
+			s := re.String()
+			re.Reset()
+			re.WriteString(strings.TrimSuffix(s, "/") + "(?:/.*)?")
+			i++
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("glob %s: unterminated [", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		return nil, fmt.Errorf("glob %s: %v", glob, err)
+	}
+	return compiled, nil
+}
+
+func matchesAny(name string, patterns []*regexp.Regexp) bool {
+	for _, re := range patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether name or any directory containing it is excluded by a glob
+func (f *fileFilter) excluded(name string) bool {
+	for ; name != "." && name != "/" && name != ""; name = filepath.Dir(name) {
+		if matchesAny(name, f.exclude) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedEntry reports whether the single entry file, stored as name, is excluded by name or regex
+func (f *fileFilter) excludedEntry(file string, name string) bool {
+	return f.excludeNames[name] || (f.excludeRegex != nil && f.excludeRegex.MatchString(file))
+}
+
+// includedEntry reports whether the single entry file, stored as name, is included by name and regex
+func (f *fileFilter) includedEntry(file string, name string) bool {
+	return (f.includeNames == nil || f.includeNames[name]) && (f.includeRegex == nil || f.includeRegex.MatchString(file))
+}
+
+// selectFiles returns the files under baseDir the filter selects, in walk order. Files are taken
+// from files when it is not nil and found by walking baseDir otherwise.
+func (f *fileFilter) selectFiles(baseDir string, files []string) ([]string, error) {
+	var candidates []string
+	if files != nil {
+		for _, file := range files {
+			name := archiveName(baseDir, file)
+			if file != baseDir && !f.excluded(name) && !f.excludedEntry(file, name) {
+				candidates = append(candidates, file)
+			}
+		}
+	} else {
+		err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == baseDir {
+				return nil
+			}
+
+			name := archiveName(baseDir, path)
+			if matchesAny(name, f.exclude) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !f.excludedEntry(path, name) {
+				candidates = append(candidates, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	selected := make(map[string]bool)
+	for _, file := range candidates {
+		name := archiveName(baseDir, file)
+		if len(f.include) == 0 {
+			selected[name] = true
+			continue
+		}
+		if !matchesAny(name, f.include) {
+			continue
+		}
+		for ; name != "." && name != "/" && name != "" && !selected[name]; name = filepath.Dir(name) {
+			selected[name] = true
+		}
+	}
+
+	var results []string
+	for _, file := range candidates {
+		if selected[archiveName(baseDir, file)] && f.includedEntry(file, archiveName(baseDir, file)) {
+			results = append(results, file)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"go.starlark.net/starlark"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gitRef describes the revision of a repository fetch should check out
+type gitRef struct {
+	branch     string
+	tag        string
+	commit     string
+	depth      int
+	submodules bool
+}
+
+func (r *gitRef) validate() error {
+	if r.tag != "" && (r.branch != "" || r.commit != "") {
+		return errors.New("tag can not be combined with branch or commit")
+	}
+
+	if r.commit != "" && !isCommitHash(r.commit) {
+		return fmt.Errorf("commit %q is not a full commit hash", r.commit)
+	}
+
+	if r.depth < 0 {
+		return fmt.Errorf("invalid depth %d", r.depth)
+	}
+
+	// an arbitrary commit can only be reached from a shallow clone of the branch that contains it
+	if r.depth > 0 && r.commit != "" && r.branch == "" {
+		return errors.New("depth requires a branch when fetching a commit")
+	}
+
+	return nil
+}
+
+// isCommitHash reports whether s is a full, hex encoded sha1
+func isCommitHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// referenceName returns the full reference to clone, short branch and tag names are expanded
+func (r *gitRef) referenceName() plumbing.ReferenceName {
+	switch {
+	case r.tag != "" && strings.HasPrefix(r.tag, "refs/"):
+		return plumbing.ReferenceName(r.tag)
+	case r.tag != "":
+		return plumbing.NewTagReferenceName(r.tag)
+	case r.branch != "" && strings.HasPrefix(r.branch, "refs/"):
+		return plumbing.ReferenceName(r.branch)
+	case r.branch != "":
+		return plumbing.NewBranchReferenceName(r.branch)
+	}
+	return plumbing.HEAD
+}
+
+func (r *gitRef) String() string {
+	switch {
+	case r.tag != "":
+		return r.tag
+	case r.commit != "":
+		return r.commit
+	case r.branch != "":
+		return r.branch
+	}
+	return "HEAD"
+}
+
+// resolveRemote returns the branch HEAD points to on the remote, other names are returned unchanged
+func resolveRemote(url string, name plumbing.ReferenceName) (plumbing.ReferenceName, error) {
+	if name != plumbing.HEAD {
+		return name, nil
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{url}})
+	auth, err := creds.gitAuth(url)
+	if err != nil {
+		return name, err
+	}
+
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return name, err
+	}
+
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference)
+	for _, ref := range refs {
+		byName[ref.Name()] = ref
+	}
+
+	// follow symbolic references such as HEAD -> refs/heads/master
+	for i := 0; i < 10; i++ {
+		ref, ok := byName[name]
+		if !ok {
+			return name, fmt.Errorf("%s not found in %s", name, url)
+		}
+
+		if ref.Type() == plumbing.SymbolicReference {
+			name = ref.Target()
+			continue
+		}
+
+		if name != plumbing.HEAD {
+			return name, nil
+		}
+
+		// without the symref capability HEAD is advertised as a hash, find the branch it matches
+		for _, candidate := range refs {
+			if candidate.Name().IsBranch() && candidate.Hash() == ref.Hash() {
+				return candidate.Name(), nil
+			}
+		}
+		return name, fmt.Errorf("unable to determine the branch HEAD refers to in %s", url)
+	}
+
+	return name, fmt.Errorf("too many symbolic references resolving %s in %s", name, url)
+}
+
+// repoName returns the name of a repository from its url, without any .git suffix
+func repoName(url string) string {
+	urlSplit := strings.Split(strings.TrimSuffix(url, "/"), "/")
+	return strings.TrimSuffix(urlSplit[len(urlSplit)-1], ".git")
+}
+
+// gitMirrorPath returns where the bare repository mirroring url is kept in the download cache
+func (c *downloadCache) gitMirrorPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, "git", hex.EncodeToString(sum[:]))
+}
+
+// openMirror opens the mirror of url in the download cache, creating it unless offline
+func openMirror(url string) (*git.Repository, string, error) {
+	dir := downloads.gitMirrorPath(url)
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		if offline {
+			return nil, dir, &offlineError{url: url}
+		}
+
+		repo, err = git.PlainInit(dir, true)
+		if err != nil {
+			return nil, dir, err
+		}
+
+		_, err = repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{url}})
+	}
+	return repo, dir, err
+}
+
+// updateMirror fetches refspecs of url into its mirror, it does nothing when offline
+func updateMirror(mirror *git.Repository, url string, depth int, refspecs ...config.RefSpec) error {
+	if offline {
+		return nil
+	}
+
+	auth, err := creds.gitAuth(url)
+	if err != nil {
+		return err
+	}
+
+	if endpoint, err := transport.NewEndpoint(url); err == nil {
+		release := downloadSlots.acquire(endpoint.Host)
+		defer release()
+	}
+
+	err = mirror.Fetch(&git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   refspecs,
+		Depth:      depth,
+		Auth:       auth,
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("fetching %s: %w", url, err)
+	}
+	return nil
+}
+
+// mirrorRef fetches ref into the mirror of url and returns the commit it refers to. Offline the
+// commit is resolved from whatever the mirror already holds.
+func mirrorRef(mirror *git.Repository, url string, name plumbing.ReferenceName, depth int) (plumbing.Hash, error) {
+	if !offline {
+		if err := updateMirror(mirror, url, depth, config.RefSpec("+"+name+":"+name)); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	ref, err := mirror.Reference(name, true)
+	if err == plumbing.ErrReferenceNotFound && offline {
+		return plumbing.ZeroHash, &offlineError{url: url + "#" + name.Short()}
+	} else if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("resolving %s of %s: %w", name.Short(), url, err)
+	}
+
+	return peelTag(mirror, ref.Hash()), nil
+}
+
+// getGit checks out exactly the requested revision of url into a directory named after that revision.
+// Tags name the directory directly, everything else is named after the commit it resolves to. An
+// existing checkout is reused as is and never pulled, so a build always sees the same sources.
+// Everything is fetched through a mirror in the download cache, offline that mirror is all there is.
+func getGit(url string, ref *gitRef, outputDir string) (starlark.Value, error) {
+	if err := ref.validate(); err != nil {
+		return starlark.None, err
+	}
+
+	progress.println("\u001b[37;1mCloning[" + ref.String() + "]: " + url + "\u001b[0m")
+
+	downloads.lock("git " + url)
+	defer downloads.unlock("git " + url)
+
+	mirror, mirrorDir, err := openMirror(url)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	hash := plumbing.NewHash(ref.commit)
+	name := ref.referenceName()
+	switch {
+	case ref.tag != "":
+		if hash, err = mirrorRef(mirror, url, name, ref.depth); err != nil {
+			return starlark.None, err
+		}
+
+	case ref.commit != "":
+		// a pinned commit that is already mirrored needs no network access at all
+		if _, err := mirror.CommitObject(hash); err != nil {
+			refspec := config.RefSpec("+refs/heads/*:refs/heads/*")
+			if ref.branch != "" {
+				refspec = config.RefSpec("+" + name + ":" + name)
+			}
+
+			if err := updateMirror(mirror, url, ref.depth, refspec); err != nil {
+				return starlark.None, err
+			}
+		}
+
+	default:
+		if !offline {
+			if name, err = resolveRemote(url, name); err != nil {
+				return starlark.None, err
+			}
+		}
+
+		if hash, err = mirrorRef(mirror, url, name, ref.depth); err != nil {
+			return starlark.None, err
+		}
+
+		if ref.branch == "" && !offline {
+			// remember the default branch so HEAD resolves the same way offline
+			if err := mirror.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, name)); err != nil {
+				return starlark.None, err
+			}
+		}
+	}
+
+	revision := ref.tag
+	if revision == "" {
+		revision = hash.String()[:12]
+	}
+
+	outputDir = outputDir + "/" + repoName(url) + "-" + revision
+
+	if _, err := os.Stat(outputDir); err == nil {
+		repo, err := git.PlainOpen(outputDir)
+		if err != nil {
+			return starlark.None, err
+		}
+
+		head, err := repo.Head()
+		if err != nil {
+			return starlark.None, err
+		}
+
+		if head.Hash() != hash {
+			if ref.tag != "" {
+				return starlark.None, fmt.Errorf("tag %s of %s has moved since %s was checked out", ref.tag, url, outputDir)
+			}
+			return starlark.None, fmt.Errorf("%s is checked out at %s, expected %s", outputDir, head.Hash(), hash)
+		}
+
+		return newGitResult(url, outputDir, repo)
+	}
+
+	if err := haveCommit(mirror, url, hash); err != nil {
+		return starlark.None, err
+	}
+
+	// clone next to the final location so an interrupted clone is never mistaken for a checkout
+	tmpDir := outputDir + ".partial"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return starlark.None, err
+	}
+
+	if err := cloneRevision(url, mirror, mirrorDir, hash, tmpDir, ref.submodules); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return starlark.None, err
+	}
+
+	if err := os.Rename(tmpDir, outputDir); err != nil {
+		return starlark.None, err
+	}
+
+	repo, err := git.PlainOpen(outputDir)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	return newGitResult(url, outputDir, repo)
+}
+
+// haveCommit fails when the mirror of url does not hold the commit hash, which offline means it
+// was never fetched
+func haveCommit(mirror *git.Repository, url string, hash plumbing.Hash) error {
+	if _, err := mirror.CommitObject(hash); err == plumbing.ErrObjectNotFound && offline {
+		return &offlineError{url: url + "#" + hash.String()}
+	} else if err != nil {
+		return fmt.Errorf("commit %s of %s: %w", hash, url, err)
+	}
+	return nil
+}
+
+// cloneRevision creates a work tree at dir from the mirror of url and checks out a detached HEAD at hash.
+// Objects are hard linked from the mirror where possible the way git clone --local does, which also
+// works for shallow mirrors and without any transport or git installation.
+func cloneRevision(url string, mirror *git.Repository, mirrorDir string, hash plumbing.Hash, dir string, submodules bool) error {
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		return err
+	}
+
+	gitDir := filepath.Join(dir, git.GitDirName)
+	if err := linkTree(filepath.Join(mirrorDir, "objects"), filepath.Join(gitDir, "objects")); err != nil {
+		return err
+	}
+
+	if err := linkTree(filepath.Join(mirrorDir, "shallow"), filepath.Join(gitDir, "shallow")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// reopen so the linked objects and shallow boundary are picked up
+	if repo, err = git.PlainOpen(dir); err != nil {
+		return err
+	}
+
+	// origin points upstream rather than at the download cache
+	if _, err := repo.CreateRemote(&config.RemoteConfig{
+		Name:  git.DefaultRemoteName,
+		URLs:  []string{url},
+		Fetch: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+	}); err != nil {
+		return err
+	}
+
+	refs, err := mirror.References()
+	if err != nil {
+		return err
+	}
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		switch {
+		case ref.Type() != plumbing.HashReference:
+			return nil
+		case ref.Name().IsTag():
+			return repo.Storer.SetReference(ref)
+		case ref.Name().IsBranch():
+			remoteName := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, ref.Name().Short())
+			return repo.Storer.SetReference(plumbing.NewHashReference(remoteName, ref.Hash()))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	workTree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if err := workTree.Checkout(&git.CheckoutOptions{Hash: hash, Force: true}); err != nil {
+		return fmt.Errorf("checking out %s of %s: %w", hash, url, err)
+	}
+
+	if submodules {
+		return updateSubmodules(workTree, dir, url)
+	}
+
+	return nil
+}
+
+// updateSubmodules checks out the submodules of a work tree from their own download cache mirrors
+func updateSubmodules(workTree *git.Worktree, dir string, parentURL string) error {
+	submodules, err := workTree.Submodules()
+	if err != nil {
+		return err
+	}
+
+	for _, submodule := range submodules {
+		cfg := submodule.Config()
+		url := submoduleURL(parentURL, cfg.URL)
+
+		status, err := submodule.Status()
+		if err != nil {
+			return err
+		}
+
+		if err := cloneSubmodule(url, status.Expected, filepath.Join(dir, cfg.Path)); err != nil {
+			return fmt.Errorf("updating submodule %s from %s: %w", cfg.Path, url, err)
+		}
+	}
+
+	return nil
+}
+
+func cloneSubmodule(url string, hash plumbing.Hash, dir string) error {
+	downloads.lock("git " + url)
+	defer downloads.unlock("git " + url)
+
+	mirror, mirrorDir, err := openMirror(url)
+	if err != nil {
+		return err
+	}
+
+	if _, err := mirror.CommitObject(hash); err != nil {
+		if err := updateMirror(mirror, url, 0, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"); err != nil {
+			return err
+		}
+	}
+
+	if err := haveCommit(mirror, url, hash); err != nil {
+		return err
+	}
+
+	// the superproject checkout leaves an empty directory where the submodule goes
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	return cloneRevision(url, mirror, mirrorDir, hash, dir, true)
+}
+
+// linkTree hard links the files under src into dst, copying them where links are not possible
+func linkTree(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		if err := os.Link(path, target); err == nil || os.IsExist(err) {
+			return nil
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+// submoduleURL resolves a submodule url that may be relative to the url of its parent repository
+func submoduleURL(parentURL string, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+
+	base := strings.TrimSuffix(parentURL, "/")
+	for _, part := range strings.Split(url, "/") {
+		switch part {
+		case ".", "":
+		case "..":
+			if i := strings.LastIndex(base, "/"); i >= 0 {
+				base = base[:i]
+			}
+		default:
+			base = base + "/" + part
+		}
+	}
+	return base
+}
+
+// newGitResult describes the commit checked out in dir
+func newGitResult(url string, dir string, repo *git.Repository) (*fetchResult, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	description, err := describe(repo, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fetchResult{
+		path:       dir,
+		url:        url,
+		commit:     commit.Hash.String(),
+		describe:   description,
+		commitTime: commit.Committer.When.Unix(),
+	}, nil
+}
+
+// describe names a commit after the closest tag in its history in the style of git describe --tags --always,
+// e.g. v1.2, v1.2-3-gabcdef1 or abcdef1 if no tag is reachable
+func describe(repo *git.Repository, commit *object.Commit) (string, error) {
+	tagged := make(map[plumbing.Hash]string)
+	tags, err := repo.Tags()
+	if err != nil {
+		return "", err
+	}
+
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		hash := peelTag(repo, ref.Hash())
+		name := ref.Name().Short()
+		// prefer the greatest name when several tags point at the same commit
+		if existing, ok := tagged[hash]; !ok || name > existing {
+			tagged[hash] = name
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	short := commit.Hash.String()[:7]
+	if len(tagged) == 0 {
+		return short, nil
+	}
+
+	history, err := repo.Log(&git.LogOptions{From: commit.Hash, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return "", err
+	}
+	defer history.Close()
+
+	description := short
+	distance := 0
+	err = history.ForEach(func(c *object.Commit) error {
+		if name, ok := tagged[c.Hash]; ok {
+			if distance == 0 {
+				description = name
+			} else {
+				description = fmt.Sprintf("%s-%d-g%s", name, distance, short)
+			}
+			return storer.ErrStop
+		}
+		distance++
+		return nil
+	})
+
+	// shallow clones end in commits whose parents are missing, that is as far as history goes
+	if err != nil && err != plumbing.ErrObjectNotFound {
+		return "", err
+	}
+
+	return description, nil
+}
+
+// peelTag returns the commit an annotated tag points to, any other hash is returned unchanged
+func peelTag(repo *git.Repository, hash plumbing.Hash) plumbing.Hash {
+	tag, err := repo.TagObject(hash)
+	if err != nil {
+		return hash
+	}
+	return tag.Target
+}
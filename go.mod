@@ -7,7 +7,10 @@ require (
 	github.com/containers/image/v5 v5.4.3
 	github.com/containers/storage v1.19.0
 	github.com/go-git/go-git/v5 v5.0.0
+	github.com/klauspost/compress v1.10.4
+	github.com/klauspost/pgzip v1.2.3
 	github.com/ulikunitz/xz v0.5.7
 	go.starlark.net v0.0.0-20200330013621-be5394c419b6
+	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
 	golang.org/x/sys v0.0.0-20200327173247-9dae0f8f5775
 )
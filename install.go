@@ -0,0 +1,480 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/esplinux/espbuild/pkginfo"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// packageDB is the directory below the root of a filesystem that records the installed packages,
+// one .json file per package holding its .PKGINFO with the files as they were installed
+const packageDB = "var/lib/esp"
+
+// database is the set of packages installed in a root filesystem
+type database struct {
+	root     string
+	packages map[string]*pkginfo.PkgInfo
+}
+
+// openDatabase reads the packages installed in root
+func openDatabase(root string) (*database, error) {
+	db := &database{root: root, packages: make(map[string]*pkginfo.PkgInfo)}
+
+	infos, err := ioutil.ReadDir(filepath.Join(root, packageDB))
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(root, packageDB, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		pkg := &pkginfo.PkgInfo{}
+		if err := json.Unmarshal(data, pkg); err != nil {
+			return nil, fmt.Errorf("%s: %w", info.Name(), err)
+		}
+		if err := checkPackageName(pkg.Name); err != nil {
+			return nil, fmt.Errorf("%s: %w", info.Name(), err)
+		}
+		db.packages[pkg.Name] = pkg
+	}
+	return db, nil
+}
+
+// checkPackageName fails for names that can not be used as the file name of a record, they come from
+// packages and the command line and must not lead out of the database directory
+func checkPackageName(name string) error {
+	if name == "" || strings.Contains(name, "/") || strings.Contains(name, "..") || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("invalid package name %q", name)
+	}
+	return nil
+}
+
+// record writes pkg to the database, replacing the record of an earlier version
+func (db *database) record(pkg *pkginfo.PkgInfo) error {
+	dir := filepath.Join(db.root, packageDB)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := pkg.Marshal()
+	if err != nil {
+		return err
+	}
+
+	// a partially written record would lose track of the files of the package
+	tmp, err := ioutil.TempFile(dir, pkg.Name+".json.*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, pkg.Name+".json")); err != nil {
+		return err
+	}
+
+	db.packages[pkg.Name] = pkg
+	return nil
+}
+
+// forget removes the record of the package name
+func (db *database) forget(name string) error {
+	if err := os.Remove(filepath.Join(db.root, packageDB, name+".json")); err != nil {
+		return err
+	}
+	delete(db.packages, name)
+	return nil
+}
+
+// ownerIndex maps the files of every installed package other than except to the package owning them,
+// directories are included when dirs is set
+func (db *database) ownerIndex(dirs bool, except string) map[string]string {
+	var names []string
+	for name := range db.packages {
+		names = append(names, name)
+	}
+	// map order would make conflict reports differ between runs
+	sort.Strings(names)
+
+	index := make(map[string]string)
+	for _, name := range names {
+		if name == except {
+			continue
+		}
+		for _, file := range db.packages[name].Files {
+			if _, ok := index[file.Name]; !ok && (dirs || file.Type != "dir") {
+				index[file.Name] = name
+			}
+		}
+	}
+	return index
+}
+
+// cleanName returns a file name the way archives and the database store it, "./usr/bin/" as "usr/bin"
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// openPackage returns the decompressed tar stream of a package file
+func openPackage(f *os.File) (io.Reader, func(), error) {
+	reader := bufio.NewReaderSize(f, 64*1024)
+	header, _ := reader.Peek(sniffLen)
+	return decompress(reader, sniffCompression(header))
+}
+
+// readPackage reads the .PKGINFO of a package and replaces its file list with the entries the package
+// actually holds and their hashes, which must agree with those recorded when it was built.
+// Packages from before .PKGINFO are named after their file.
+func readPackage(file string) (*pkginfo.PkgInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	stream, closer, err := openPackage(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	defer closer()
+
+	var pkg *pkginfo.PkgInfo
+	var files []pkginfo.File
+
+	tr := tar.NewReader(stream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		if header.Name == pkginfo.Name {
+			pkg = &pkginfo.PkgInfo{}
+			if err := json.NewDecoder(tr).Decode(pkg); err != nil {
+				return nil, fmt.Errorf("%s: reading %s: %w", file, pkginfo.Name, err)
+			}
+			continue
+		}
+
+		sum := ""
+		if header.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", file, header.Name, err)
+			}
+			sum = hex.EncodeToString(h.Sum(nil))
+		}
+
+		entry := pkginfo.NewFile(header, sum)
+		entry.Name = cleanName(header.Name)
+		if entry.Name != "" {
+			files = append(files, entry)
+		}
+	}
+
+	if pkg == nil {
+		name := filepath.Base(file)
+		for _, ext := range []string{".tgz", ".tar.gz", ".tar.xz", ".tar.zst", ".tar"} {
+			name = strings.TrimSuffix(name, ext)
+		}
+		warn(fmt.Sprintf("%s has no %s, installing it as %s", file, pkginfo.Name, name))
+		pkg = &pkginfo.PkgInfo{Name: name}
+	}
+	if err := checkPackageName(pkg.Name); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	built := make(map[string]string)
+	for _, entry := range pkg.Files {
+		built[cleanName(entry.Name)] = entry.SHA256
+	}
+	for _, entry := range files {
+		if sum, ok := built[entry.Name]; ok && sum != entry.SHA256 {
+			return nil, fmt.Errorf("%s: %s does not match the hash recorded in %s", file, entry.Name, pkginfo.Name)
+		}
+	}
+
+	pkg.Files = files
+	return pkg, nil
+}
+
+// conflicts returns the files of pkg that belong to other installed packages, or when force is not
+// set, exist in the root filesystem without belonging to any package
+func (db *database) conflicts(pkg *pkginfo.PkgInfo, force bool) []string {
+	others := db.ownerIndex(false, pkg.Name)
+	owned := db.ownerIndex(false, "")
+
+	var conflicts []string
+	for _, entry := range pkg.Files {
+		dir := entry.Type == "dir"
+
+		// a file reached through a symlinked directory is the file the symlink leads to, directories
+		// are followed the way they are extracted
+		target, err := resolveInRoot(db.root, entry.Name, dir, true)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %v", entry.Name, err))
+			continue
+		}
+		real, err := filepath.Rel(db.root, target)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %v", entry.Name, err))
+			continue
+		}
+
+		if other := others[entry.Name]; other != "" && !dir {
+			conflicts = append(conflicts, fmt.Sprintf("%s is owned by %s", entry.Name, other))
+			continue
+		}
+		if other := others[real]; other != "" && !dir {
+			conflicts = append(conflicts, fmt.Sprintf("%s is %s owned by %s", entry.Name, real, other))
+			continue
+		}
+
+		info, err := os.Lstat(target)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case dir && !info.IsDir():
+			conflicts = append(conflicts, fmt.Sprintf("%s is a directory in %s but not in %s", entry.Name, pkg.Name, db.root))
+		case !dir && info.IsDir():
+			conflicts = append(conflicts, fmt.Sprintf("%s is a directory in %s", entry.Name, db.root))
+		case !dir && !force && owned[entry.Name] == "" && owned[real] == "":
+			conflicts = append(conflicts, fmt.Sprintf("%s exists and is not owned by any package", entry.Name))
+		}
+	}
+	return conflicts
+}
+
+// install extracts the package file into the root filesystem and records it. Installing a package
+// again replaces it, files the new version no longer has are removed.
+func (db *database) install(file string, force bool) error {
+	pkg, err := readPackage(file)
+	if err != nil {
+		return err
+	}
+
+	if conflicts := db.conflicts(pkg, force); len(conflicts) > 0 {
+		return fmt.Errorf("%s conflicts with the installed files:\n\t%s", pkg.Name, strings.Join(conflicts, "\n\t"))
+	}
+
+	old := db.packages[pkg.Name]
+	files := make(map[string]pkginfo.File)
+	for _, entry := range pkg.Files {
+		files[entry.Name] = entry
+	}
+
+	var stale []pkginfo.File
+	if old != nil {
+		for _, entry := range old.Files {
+			if _, ok := files[entry.Name]; !ok {
+				stale = append(stale, entry)
+			}
+		}
+	}
+
+	// recorded with the files of both versions before extracting, remove cleans up after an install
+	// that never finished
+	pending := *pkg
+	pending.Files = append(append([]pkginfo.File{}, pkg.Files...), stale...)
+	if err := db.record(&pending); err != nil {
+		return err
+	}
+
+	if err := db.extract(file, files); err != nil {
+		// UnTar removed what it created, the record goes back to what is still installed
+		if old != nil {
+			err = rollback(err, db.record(old))
+		} else {
+			err = rollback(err, db.forget(pkg.Name))
+		}
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	if err := db.record(pkg); err != nil {
+		return err
+	}
+	db.removeFiles(stale)
+
+	fmt.Printf("Installed: %s %s-%s\n", pkg.Name, pkg.Version, pkg.Rev)
+	return nil
+}
+
+// rollback returns err, mentioning undoErr when undoing a failed install failed as well
+func rollback(err error, undoErr error) error {
+	if undoErr != nil {
+		return fmt.Errorf("%w, restoring the package record: %v", err, undoErr)
+	}
+	return err
+}
+
+// extract extracts the package file into the root filesystem. The package is read again, every
+// entry must be one of files as readPackage found them so what is installed is what was checked.
+func (db *database) extract(file string, files map[string]pkginfo.File) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	stream, closer, err := openPackage(f)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	// a root filesystem is its own root, absolute symlinks point inside it
+	opts := extractOptions{
+		absoluteSymlinks: true,
+		xattrNamespaces:  defaultXattrNamespaces,
+		owners:           true,
+		skipPkgInfo:      true,
+		files:            files,
+	}
+	_, err = UnTar(stream, db.root, opts)
+	return err
+}
+
+// remove deletes the files of the installed package name and its record
+func (db *database) remove(name string) error {
+	if err := checkPackageName(name); err != nil {
+		return err
+	}
+
+	pkg, ok := db.packages[name]
+	if !ok {
+		return fmt.Errorf("%s is not installed", name)
+	}
+
+	if err := db.forget(name); err != nil {
+		return err
+	}
+	db.removeFiles(pkg.Files)
+
+	fmt.Printf("Removed: %s %s-%s\n", pkg.Name, pkg.Version, pkg.Rev)
+	return nil
+}
+
+// removeFiles deletes files from the root filesystem, children before their directories. Directories
+// are only removed once empty and when no installed package still has them.
+func (db *database) removeFiles(files []pkginfo.File) {
+	names := make([]string, len(files))
+	types := make(map[string]string)
+	for i, file := range files {
+		names[i] = file.Name
+		types[file.Name] = file.Type
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	dirs := db.ownerIndex(true, "")
+
+	for _, name := range names {
+		// resolved like install does so symlinks inside the root never lead to files of the host,
+		// a symlink of the package itself is removed rather than followed
+		target, err := resolveInRoot(db.root, name, false, true)
+		if err != nil {
+			warn(fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+
+		if types[name] == "dir" {
+			if dirs[name] != "" {
+				continue
+			}
+			// directories holding files of no package are left alone
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTEMPTY) {
+				warn(err.Error())
+			}
+			continue
+		}
+
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			warn(err.Error())
+		}
+	}
+}
+
+// packageCommand runs "install" or "remove" with their arguments
+func packageCommand(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	root := flags.String("root", "", "root `directory` of the filesystem to change")
+	force := false
+	if command == "install" {
+		flags.BoolVar(&force, "force", false, "overwrite files that exist without belonging to any package")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *root == "" {
+		return fmt.Errorf("%s: --root is required", command)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("%s: no packages given", command)
+	}
+
+	// paths inside the root are compared with it as strings, "./rootfs/" must be spelled like them
+	rootDir, err := filepath.Abs(*root)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(rootDir)
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range flags.Args() {
+		if command == "install" {
+			err = db.install(arg, force)
+		} else {
+			err = db.remove(arg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/esplinux/espbuild/pkginfo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveThroughAbsoluteSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// host stands for /run of the machine, var/run of the root links to it the way Debian does
+	host := filepath.Join(dir, "host")
+	root := filepath.Join(dir, "root")
+	writeTree(t, host, map[string]testFile{"app.pid": {content: "1\n"}})
+	if err := os.MkdirAll(filepath.Join(root, "var"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(host, filepath.Join(root, "var/run")); err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, filepath.Join(root, host), map[string]testFile{"app.pid": {content: "1\n"}})
+
+	db, err := openDatabase(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := &pkginfo.PkgInfo{Name: "app", Files: []pkginfo.File{
+		{Name: "var/run/app.pid", Type: "file"},
+		{Name: "var/run", Type: "symlink", Link: host},
+	}}
+	if err := db.record(pkg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.remove("app"); err != nil {
+		t.Fatalf("remove() = %v", err)
+	}
+
+	checkTree(t, host, map[string]testFile{"app.pid": {content: "1\n"}})
+	checkTree(t, filepath.Join(root, host), map[string]testFile{})
+	if _, err := os.Lstat(filepath.Join(root, "var/run")); !os.IsNotExist(err) {
+		t.Errorf("var/run of the root was not removed: %v", err)
+	}
+}
+
+func TestCheckPackageName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "busybox", valid: true},
+		{name: "libstdc++-dev", valid: true},
+		{name: "python3.8", valid: true},
+		{name: ""},
+		{name: "../../etc/foo"},
+		{name: ".."},
+		{name: "a/b"},
+		{name: "a\x00b"},
+	}
+
+	for _, test := range tests {
+		if err := checkPackageName(test.name); (err == nil) != test.valid {
+			t.Errorf("checkPackageName(%q) = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
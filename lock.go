@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// lockFileName is the name of the lock file written next to each build file
+const lockFileName = "espbuild.lock"
+
+// lockVersion is the version of the lock file format
+const lockVersion = 1
+
+// lockMode controls how fetch uses and maintains lock files
+type lockMode int
+
+const (
+	// lockRecord honours existing entries and records new fetches
+	lockRecord lockMode = iota
+	// lockFrozen requires every fetch to match an existing entry and never writes the lock file
+	lockFrozen
+	// lockUpdate ignores existing entries and rewrites the lock file with what was fetched
+	lockUpdate
+)
+
+// lockEntry records the resolved inputs of a single fetch
+type lockEntry struct {
+	URL      string `json:"url"`
+	Ref      string `json:"ref,omitempty"`
+	FinalURL string `json:"final_url,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Commit   string `json:"commit,omitempty"`
+}
+
+// lockFile is the espbuild.lock of one directory of build files
+type lockFile struct {
+	Version int                   `json:"version"`
+	Fetches map[string]*lockEntry `json:"fetches"`
+
+	path  string
+	dirty bool
+	seen  map[string]bool
+}
+
+// lockFiles is every lock file used by the current run
+type lockFiles struct {
+	mu    sync.Mutex
+	mode  lockMode
+	files map[string]*lockFile
+}
+
+// locks is the lock state shared by every fetch, configured in main
+var locks = &lockFiles{files: make(map[string]*lockFile)}
+
+// httpLockKey and gitLockKey name the entry of a fetch within a lock file
+func httpLockKey(url string) string {
+	return url
+}
+
+func gitLockKey(url string, ref *gitRef) string {
+	return url + "#" + ref.String()
+}
+
+// load returns the lock file for dir, reading it on first use. Callers must hold l.mu.
+func (l *lockFiles) load(dir string) (*lockFile, error) {
+	if lf, ok := l.files[dir]; ok {
+		return lf, nil
+	}
+
+	lf := &lockFile{
+		Version: lockVersion,
+		Fetches: make(map[string]*lockEntry),
+		path:    filepath.Join(dir, lockFileName),
+		seen:    make(map[string]bool),
+	}
+
+	data, err := ioutil.ReadFile(lf.path)
+	if err == nil {
+		if err := json.Unmarshal(data, lf); err != nil {
+			return nil, fmt.Errorf("%s: %w", lf.path, err)
+		}
+		if lf.Version != lockVersion {
+			return nil, fmt.Errorf("%s: unsupported lock file version %d", lf.path, lf.Version)
+		}
+		if lf.Fetches == nil {
+			lf.Fetches = make(map[string]*lockEntry)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l.files[dir] = lf
+	return lf, nil
+}
+
+// lookup returns the locked entry for key in dir, or nil if fetch is free to resolve it.
+// In frozen mode an entry that does not exist is an error.
+func (l *lockFiles) lookup(dir string, key string) (*lockEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lf, err := l.load(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.mode == lockUpdate {
+		return nil, nil
+	}
+
+	entry, ok := lf.Fetches[key]
+	if !ok && l.mode == lockFrozen {
+		return nil, fmt.Errorf("%s is not in %s, run espbuild lock to add it", key, lf.path)
+	}
+	return entry, nil
+}
+
+// record stores the resolved inputs of a fetch
+func (l *lockFiles) record(dir string, key string, entry *lockEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lf, err := l.load(dir)
+	if err != nil {
+		return err
+	}
+
+	lf.seen[key] = true
+	if existing, ok := lf.Fetches[key]; ok && existing.SHA256 == entry.SHA256 && existing.Commit == entry.Commit {
+		// where a download came from is informational, cache hits do not know it at all
+		if entry.FinalURL == "" || entry.FinalURL == existing.FinalURL || l.mode == lockFrozen {
+			return nil
+		}
+	} else if l.mode == lockFrozen {
+		return fmt.Errorf("%s does not match %s, run espbuild lock --update to refresh it", key, lf.path)
+	}
+
+	lf.Fetches[key] = entry
+	lf.dirty = true
+	return nil
+}
+
+// save writes every lock file changed by this run. When updating, entries for fetches that no
+// longer happen are dropped, unless complete is false because a build file stopped before
+// reaching all of its fetches.
+func (l *lockFiles) save(complete bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.mode == lockFrozen {
+		return nil
+	}
+
+	for _, lf := range l.files {
+		if l.mode == lockUpdate && complete {
+			for key := range lf.Fetches {
+				if !lf.seen[key] {
+					delete(lf.Fetches, key)
+					lf.dirty = true
+				}
+			}
+		}
+
+		if !lf.dirty {
+			continue
+		}
+
+		data, err := json.MarshalIndent(lf, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(lf.path, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockHttp pins an http fetch to the sha256 recorded in the lock file of dir
+func lockHttp(dir string, url string, checksums []*checksum) ([]*checksum, error) {
+	entry, err := locks.lookup(dir, httpLockKey(url))
+	if err != nil || entry == nil {
+		return checksums, err
+	}
+
+	if sum := expectedSHA256(checksums); sum != "" {
+		if sum != entry.SHA256 {
+			return nil, fmt.Errorf("sha256 %s of %s does not match %s in %s", sum, url, entry.SHA256, lockFileName)
+		}
+		return checksums, nil
+	}
+
+	locked, err := newChecksum("sha256", entry.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", lockFileName, err)
+	}
+	return append(checksums, locked), nil
+}
+
+// recordHttp records what an http fetch resolved to in the lock file of dir
+func recordHttp(dir string, url string, result *fetchResult) error {
+	return locks.record(dir, httpLockKey(url), &lockEntry{
+		URL:      url,
+		FinalURL: result.finalURL,
+		SHA256:   result.sha256,
+	})
+}
+
+// lockGit pins a git fetch to the commit recorded in the lock file of dir, returning the locked entry
+func lockGit(dir string, url string, ref *gitRef) (*lockEntry, error) {
+	entry, err := locks.lookup(dir, gitLockKey(url, ref))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	// tags check out their own directory, they are verified against the lock once fetched
+	if ref.tag == "" {
+		ref.commit = entry.Commit
+		if ref.branch == "" {
+			ref.depth = 0
+		}
+	}
+
+	return entry, nil
+}
+
+// recordGit records the commit a git fetch resolved to in the lock file of dir
+func recordGit(dir string, url string, key string, locked *lockEntry, result *fetchResult) error {
+	if locked != nil && locked.Commit != result.commit {
+		return fmt.Errorf("%s resolved to %s, expected %s from %s", key, result.commit, locked.Commit, lockFileName)
+	}
+
+	return locks.record(dir, key, &lockEntry{
+		URL:    url,
+		Ref:    key[len(url)+1:],
+		Commit: result.commit,
+	})
+}
+
+// skipBuildSteps replaces the builtins that build and package with ones that do nothing, lock runs
+// build files only for their fetches. Skipped steps return their first argument where it is
+// passed on, like the source of patch, and empty values otherwise.
+func skipBuildSteps(predeclared starlark.StringDict) {
+	skip := func(name string, result func(args starlark.Tuple, kwargs []starlark.Tuple) starlark.Value) *starlark.Builtin {
+		return starlark.NewBuiltin(name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			debug("skipping " + b.Name() + " " + thread.Name)
+			return result(args, kwargs), nil
+		})
+	}
+
+	argument := func(param string) func(args starlark.Tuple, kwargs []starlark.Tuple) starlark.Value {
+		return func(args starlark.Tuple, kwargs []starlark.Tuple) starlark.Value {
+			if len(args) > 0 {
+				return args[0]
+			}
+			for _, kwarg := range kwargs {
+				if string(kwarg[0].(starlark.String)) == param {
+					return kwarg[1]
+				}
+			}
+			return starlark.None
+		}
+	}
+
+	none := func(args starlark.Tuple, kwargs []starlark.Tuple) starlark.Value {
+		return starlark.None
+	}
+
+	predeclared["shell"] = skip("shell", func(args starlark.Tuple, kwargs []starlark.Tuple) starlark.Value {
+		return starlark.String("")
+	})
+	predeclared["patch"] = skip("patch", argument("source"))
+	predeclared["tar"] = skip("tar", argument("name"))
+	predeclared["partition"] = skip("partition", func(args starlark.Tuple, kwargs []starlark.Tuple) starlark.Value {
+		return &starlark.Dict{}
+	})
+	predeclared["container"] = skip("container", func(args starlark.Tuple, kwargs []starlark.Tuple) starlark.Value {
+		return starlarkstruct.FromStringDict(starlark.String("container"), starlark.StringDict{
+			"add":    skip("container.add", none),
+			"run":    skip("container.run", none),
+			"setCmd": skip("container.setCmd", none),
+			"commit": skip("container.commit", none),
+		})
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// mirror rewrites urls starting with prefix to start with replacement instead
+type mirror struct {
+	prefix      string
+	replacement string
+}
+
+// mirrors is the global mirror configuration, loaded in main
+var mirrors []mirror
+
+// defaultMirrorsFile returns $ESPBUILD_MIRRORS, the mirror configuration used when no flag is given
+func defaultMirrorsFile() string {
+	return os.Getenv("ESPBUILD_MIRRORS")
+}
+
+// loadMirrors reads a mirror configuration, one "prefix replacement" pair per line.
+// Blank lines and lines starting with # are ignored, a prefix may be listed more than once.
+func loadMirrors(path string) ([]mirror, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			warn(err.Error())
+		}
+	}()
+
+	var result []mirror
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"prefix replacement\", got %q", path, lineNo, line)
+		}
+		result = append(result, mirror{prefix: fields[0], replacement: fields[1]})
+	}
+
+	return result, scanner.Err()
+}
+
+// mirrored returns the urls to try in order, configured mirrors of each url come before the url itself
+func mirrored(urls []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	add := func(url string) {
+		if !seen[url] {
+			seen[url] = true
+			result = append(result, url)
+		}
+	}
+
+	for _, url := range urls {
+		for _, m := range mirrors {
+			if strings.HasPrefix(url, m.prefix) {
+				add(m.replacement + strings.TrimPrefix(url, m.prefix))
+			}
+		}
+		add(url)
+	}
+	return result
+}
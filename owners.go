@@ -0,0 +1,281 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// owner is the user and group stored in tar headers in place of whoever built the package
+type owner struct {
+	uid   int
+	gid   int
+	uname string
+	gname string
+}
+
+// ownership is the owner and permissions of a single archive entry, mode is -1 to keep the
+// permissions of the file
+type ownership struct {
+	owner
+	mode int64
+}
+
+// device is a device node or fifo declared by a recipe rather than created on the filesystem
+type device struct {
+	typeflag  byte
+	major     int64
+	minor     int64
+	ownership *ownership
+}
+
+// deviceTypes maps the types of device specs to tar entry types
+var deviceTypes = map[string]byte{
+	"c": tar.TypeChar,
+	"b": tar.TypeBlock,
+	"p": tar.TypeFifo,
+}
+
+// parseOwner parses "user:group", both either numeric ids or names. Names are stored along with
+// their ids from the passwd and group files of baseDir, root is always 0. Names baseDir does not
+// define must be given with the id to store as "name=id", the installer resolves them again.
+func parseOwner(spec string, baseDir string) (*owner, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("owner %q is not user:group", spec)
+	}
+
+	var err error
+	o := &owner{}
+	if o.uid, o.uname, err = resolveID(parts[0], filepath.Join(baseDir, "etc", "passwd")); err != nil {
+		return nil, fmt.Errorf("owner %q: user %v", spec, err)
+	}
+	if o.gid, o.gname, err = resolveID(parts[1], filepath.Join(baseDir, "etc", "group")); err != nil {
+		return nil, fmt.Errorf("owner %q: group %v", spec, err)
+	}
+	return o, nil
+}
+
+// parseOwnership parses "user:group:mode" as in owners={"usr/bin/sudo": "root:root:4755"}, the mode
+// is octal and may be left out
+func parseOwnership(spec string, baseDir string) (*ownership, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("ownership %q is not user:group:mode", spec)
+	}
+
+	o, err := parseOwner(strings.Join(parts[:2], ":"), baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := int64(-1)
+	if len(parts) == 3 {
+		mode, err = strconv.ParseInt(parts[2], 8, 64)
+		if err != nil || mode < 0 || mode > 07777 {
+			return nil, fmt.Errorf("ownership %q: %q is not an octal mode", spec, parts[2])
+		}
+	}
+
+	return &ownership{owner: *o, mode: mode}, nil
+}
+
+// parseDevice parses "type:major:minor:user:group:mode" where type is c, b or p for character
+// devices, block devices and fifos. The ownership may be left out for the default owner and 0600.
+func parseDevice(spec string, baseDir string) (*device, error) {
+	parts := strings.SplitN(spec, ":", 4)
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("device %q is not type:major:minor:user:group:mode", spec)
+	}
+
+	typeflag, ok := deviceTypes[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("device %q: type must be c, b or p", spec)
+	}
+
+	major, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || major < 0 {
+		return nil, fmt.Errorf("device %q: %q is not a major number", spec, parts[1])
+	}
+	minor, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || minor < 0 {
+		return nil, fmt.Errorf("device %q: %q is not a minor number", spec, parts[2])
+	}
+
+	d := &device{typeflag: typeflag, major: major, minor: minor}
+	if len(parts) == 4 {
+		if d.ownership, err = parseOwnership(parts[3], baseDir); err != nil {
+			return nil, fmt.Errorf("device %q: %v", spec, err)
+		}
+	}
+	return d, nil
+}
+
+// resolveID returns the id and name for a user or group given as either, or as "name=id". Names are
+// looked up in file, which is a passwd or group file, and fail when it does not define them unless
+// an id was given to fall back to.
+func resolveID(value string, file string) (int, string, error) {
+	if id, err := strconv.Atoi(value); err == nil {
+		return id, "", nil
+	}
+
+	name, fallback := value, ""
+	if i := strings.Index(value, "="); i >= 0 {
+		name, fallback = value[:i], value[i+1:]
+	}
+	if name == "" {
+		return 0, "", fmt.Errorf("%q has no name", value)
+	}
+	if name == "root" {
+		return 0, name, nil
+	}
+
+	if id, ok := lookupID(name, file); ok {
+		return id, name, nil
+	}
+	if fallback == "" {
+		return 0, "", fmt.Errorf("%s is not in %s, give its id as %s=id", name, file, name)
+	}
+	id, err := strconv.Atoi(fallback)
+	if err != nil || id < 0 {
+		return 0, "", fmt.Errorf("%q: %q is not an id", value, fallback)
+	}
+	return id, name, nil
+}
+
+// lookupID returns the id of the user or group name in file, which is a passwd or group file
+func lookupID(name string, file string) (int, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, false
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		if id, err := strconv.Atoi(fields[2]); err == nil {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// restoreOwner gives an extracted entry the owner and mode recorded in its header. User and group
+// names are looked up in the passwd and group files of root, ids are used for names root does
+// not know and the setuid or setgid bit is then dropped. Owners the user may not set are skipped
+// with a warning.
+func restoreOwner(header *tar.Header, target string, root string) error {
+	// hardlinks share the owner of the entry they link to
+	if header.Typeflag == tar.TypeLink {
+		return nil
+	}
+
+	mode := header.Mode & 07777
+	uid, uidOK := restoreID(header.Uid, header.Uname, filepath.Join(root, "etc", "passwd"))
+	gid, gidOK := restoreID(header.Gid, header.Gname, filepath.Join(root, "etc", "group"))
+	// an id of the build machine may belong to anyone here, it is not trusted with privileges
+	if !uidOK && mode&04000 != 0 {
+		warn(fmt.Sprintf("%s: user %s is not in %s, dropping the setuid bit", header.Name, header.Uname, root))
+		mode &^= 04000
+	}
+	if !gidOK && mode&02000 != 0 {
+		warn(fmt.Sprintf("%s: group %s is not in %s, dropping the setgid bit", header.Name, header.Gname, root))
+		mode &^= 02000
+	}
+
+	if err := os.Lchown(target, uid, gid); os.IsPermission(err) {
+		warn(fmt.Sprintf("not restoring owner of %s: %v", header.Name, err))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// changing the owner clears the setuid and setgid bits, symlinks have no mode of their own
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	return unix.Chmod(target, uint32(mode))
+}
+
+// restoreID returns the id of the user or group name in file, or id when the name is not given. Names
+// file does not define fall back to id and are reported as not resolved.
+func restoreID(id int, name string, file string) (int, bool) {
+	switch name {
+	case "":
+		return id, true
+	case "root":
+		return 0, true
+	}
+	if found, ok := lookupID(name, file); ok {
+		return found, true
+	}
+	return id, false
+}
+
+// apply stores the owner in header
+func (o *owner) apply(header *tar.Header) {
+	header.Uid = o.uid
+	header.Gid = o.gid
+	header.Uname = o.uname
+	header.Gname = o.gname
+}
+
+// apply stores the owner and mode in header
+func (o *ownership) apply(header *tar.Header) {
+	o.owner.apply(header)
+	if o.mode >= 0 {
+		header.Mode = o.mode
+	}
+}
+
+// header returns the tar header of the device node name, it is owned by the default owner with
+// mode 0600 unless the device spec says otherwise
+func (d *device) header(name string, opts tarOptions) *tar.Header {
+	header := &tar.Header{
+		Typeflag: d.typeflag,
+		Name:     name,
+		Mode:     0600,
+		Devmajor: d.major,
+		Devminor: d.minor,
+		ModTime:  time.Now().Truncate(time.Second),
+	}
+	if opts.reproducible {
+		header.ModTime = opts.epoch
+	}
+
+	if opts.owner != nil {
+		opts.owner.apply(header)
+	}
+	if d.ownership != nil {
+		d.ownership.apply(header)
+	}
+	return header
+}
+
+// unmatched returns an error naming the entries of names, declared in the option kind, that were
+// not found in the archive
+func unmatched(kind string, names map[string]bool) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	var missing []string
+	for name := range names {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("%s given for files not in the archive: %s", kind, strings.Join(missing, ", "))
+}
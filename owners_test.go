@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "owners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	group := filepath.Join(dir, "group")
+	if err := ioutil.WriteFile(group, []byte("root:x:0:\ncrontab:x:101:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value string
+		id    int
+		name  string
+		err   string
+	}{
+		{value: "0", id: 0},
+		{value: "42", id: 42},
+		{value: "root", id: 0, name: "root"},
+		{value: "crontab", id: 101, name: "crontab"},
+		{value: "crontab=200", id: 101, name: "crontab"},
+		{value: "cron=200", id: 200, name: "cron"},
+		{value: "cron", err: "cron is not in"},
+		{value: "cron=x", err: `"x" is not an id`},
+		{value: "=1", err: "has no name"},
+	}
+
+	for _, test := range tests {
+		id, name, err := resolveID(test.value, group)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("resolveID(%q) = %v, want an error containing %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil || id != test.id || name != test.name {
+			t.Errorf("resolveID(%q) = %d, %q, %v, want %d, %q", test.value, id, name, err, test.id, test.name)
+		}
+	}
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// filePatch is the change a patch makes to a single file. An empty oldName creates the file and an
+// empty newName deletes it, a rename or copy has differing names.
+type filePatch struct {
+	oldName string
+	newName string
+	oldMode os.FileMode
+	newMode os.FileMode
+	git     bool
+	copy    bool
+	hunks   []*hunk
+
+	// the line of the patch the change starts on, used in error messages
+	line int
+}
+
+// hunk is a single @@ section of a unified diff. Lines keep their ' ', '-' or '+' prefix and
+// their newline, which is dropped where the diff says there is none at the end of the file.
+type hunk struct {
+	oldStart int
+	oldLines int
+	newStart int
+	newLines int
+	lines    []string
+}
+
+// hunkError describes why a hunk could not be applied
+type hunkError struct {
+	file   string
+	hunk   int
+	line   int
+	reason string
+}
+
+func (e *hunkError) Error() string {
+	return fmt.Sprintf("%s: hunk #%d FAILED at %d: %s", e.file, e.hunk, e.line, e.reason)
+}
+
+// patchError lists every hunk of a patch file that failed to apply
+type patchError struct {
+	patch    string
+	failures []error
+}
+
+func (e *patchError) Error() string {
+	messages := make([]string, len(e.failures))
+	for i, failure := range e.failures {
+		messages[i] = "  " + failure.Error()
+	}
+	return fmt.Sprintf("applying %s failed:\n%s", e.patch, strings.Join(messages, "\n"))
+}
+
+// Patch applies each patch file in turn to the source tree. Every patch applies completely or
+// leaves the tree untouched.
+func Patch(source string, patches []string, strip int, fuzz int) error {
+	for _, patchFile := range patches {
+		progress.println("\u001b[37;1mPatching: " + source + " with " + filepath.Base(patchFile) + "\u001b[0m")
+
+		data, err := ioutil.ReadFile(patchFile)
+		if err != nil {
+			return err
+		}
+
+		filePatches, err := parsePatch(string(data), strip)
+		if err != nil {
+			return fmt.Errorf("%s: %w", patchFile, err)
+		}
+
+		if len(filePatches) == 0 {
+			return fmt.Errorf("%s: no changes found", patchFile)
+		}
+
+		tree := &patchTree{source: source, files: make(map[string]*patchedFile)}
+		var failures []error
+		for _, fp := range filePatches {
+			if err := tree.apply(fp, fuzz); err != nil {
+				var hunkErrors *patchError
+				if errors.As(err, &hunkErrors) {
+					failures = append(failures, hunkErrors.failures...)
+				} else {
+					failures = append(failures, err)
+				}
+			}
+		}
+
+		if len(failures) > 0 {
+			return &patchError{patch: patchFile, failures: failures}
+		}
+
+		if err := tree.commit(); err != nil {
+			return fmt.Errorf("%s: %w", patchFile, err)
+		}
+	}
+
+	return nil
+}
+
+// parsePatch reads the file changes of a unified or git diff, ignoring any text around them.
+// strip leading path components are removed from the names on the ---, +++ and diff --git lines.
+func parsePatch(data string, strip int) ([]*filePatch, error) {
+	lines := strings.SplitAfter(data, "\n")
+
+	var patches []*filePatch
+	var current *filePatch
+	// the git extended header ends at the first --- line or hunk
+	inHeader := false
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		text := strings.TrimRight(line, "\r\n")
+
+		switch {
+		case strings.HasPrefix(text, "diff --git "):
+			oldName, newName, err := parseGitNames(text[len("diff --git "):], strip)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			current = &filePatch{oldName: oldName, newName: newName, git: true, line: i + 1}
+			patches = append(patches, current)
+			inHeader = true
+
+		case inHeader && strings.HasPrefix(text, "old mode "):
+			mode, err := parseGitMode(text[len("old mode "):])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			current.oldMode = mode
+
+		case inHeader && strings.HasPrefix(text, "new mode "):
+			mode, err := parseGitMode(text[len("new mode "):])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			current.newMode = mode
+
+		case inHeader && strings.HasPrefix(text, "new file mode "):
+			mode, err := parseGitMode(text[len("new file mode "):])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			current.oldName = ""
+			current.newMode = mode
+
+		case inHeader && strings.HasPrefix(text, "deleted file mode "):
+			current.newName = ""
+
+		case inHeader && (strings.HasPrefix(text, "rename from ") || strings.HasPrefix(text, "copy from ")):
+			// rename and copy names never carry the a/ and b/ prefixes
+			current.oldName = unquoteName(text[strings.Index(text, " from ")+len(" from "):])
+			current.copy = strings.HasPrefix(text, "copy ")
+
+		case inHeader && (strings.HasPrefix(text, "rename to ") || strings.HasPrefix(text, "copy to ")):
+			current.newName = unquoteName(text[strings.Index(text, " to ")+len(" to "):])
+
+		case inHeader && (strings.HasPrefix(text, "GIT binary patch") || strings.HasPrefix(text, "Binary files ")):
+			return nil, fmt.Errorf("line %d: binary patches are not supported", i+1)
+
+		case strings.HasPrefix(text, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			oldName, err := parseName(text[len("--- "):], strip)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			newName, err := parseName(strings.TrimRight(lines[i+1][len("+++ "):], "\r\n"), strip)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+2, err)
+			}
+
+			if !inHeader {
+				current = &filePatch{line: i + 1}
+				patches = append(patches, current)
+			}
+
+			// git already named the files, the ---/+++ lines only matter for plain diffs
+			if !current.git {
+				current.oldName = oldName
+				current.newName = newName
+			}
+			inHeader = false
+			i++
+
+		case strings.HasPrefix(text, "@@ "):
+			if current == nil {
+				return nil, fmt.Errorf("line %d: hunk without a file header", i+1)
+			}
+			inHeader = false
+
+			h, err := parseHunkHeader(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+
+			n, err := h.readLines(lines[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			current.hunks = append(current.hunks, h)
+			i += n
+		}
+	}
+
+	for _, fp := range patches {
+		if fp.oldName == "" && fp.newName == "" {
+			return nil, fmt.Errorf("line %d: change has no file name", fp.line)
+		}
+	}
+
+	return patches, nil
+}
+
+// parseName reads a file name from a ---/+++ line, dropping any timestamp after a tab
+func parseName(text string, strip int) (string, error) {
+	if i := strings.IndexByte(text, '\t'); i >= 0 {
+		text = text[:i]
+	}
+
+	name := unquoteName(strings.TrimSpace(text))
+	if name == "/dev/null" {
+		return "", nil
+	}
+	return stripName(name, strip)
+}
+
+// parseGitNames splits the a/ and b/ names of a diff --git line. Unquoted names may contain
+// spaces, the names are the same unless the file was renamed in which case the rename lines
+// provide them.
+func parseGitNames(text string, strip int) (string, string, error) {
+	var oldName, newName string
+
+	if strings.HasPrefix(text, "\"") {
+		end := closingQuote(text)
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated name in diff --git %s", text)
+		}
+		oldName, newName = unquoteName(text[:end+1]), unquoteName(strings.TrimSpace(text[end+1:]))
+	} else if strings.HasSuffix(text, "\"") {
+		start := strings.Index(text, " \"")
+		if start < 0 {
+			return "", "", fmt.Errorf("unterminated name in diff --git %s", text)
+		}
+		oldName, newName = text[:start], unquoteName(text[start+1:])
+	} else {
+		// look for the split that gives two names which match once their prefix is dropped
+		oldName, newName = text, text
+		for i := strings.IndexByte(text, ' '); i >= 0; i = nextSpace(text, i) {
+			left, right := text[:i], text[i+1:]
+			l, lerr := stripName(left, 1)
+			r, rerr := stripName(right, 1)
+			if lerr == nil && rerr == nil && l == r {
+				oldName, newName = left, right
+				break
+			}
+		}
+	}
+
+	oldName, err := stripName(oldName, strip)
+	if err != nil {
+		return "", "", err
+	}
+	newName, err = stripName(newName, strip)
+	return oldName, newName, err
+}
+
+func nextSpace(text string, i int) int {
+	j := strings.IndexByte(text[i+1:], ' ')
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// closingQuote returns the index of the quote ending the C style string at the start of text
+func closingQuote(text string) int {
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// unquoteName decodes the C style quoting git uses for names with special characters
+func unquoteName(name string) string {
+	if len(name) >= 2 && strings.HasPrefix(name, "\"") && strings.HasSuffix(name, "\"") {
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			return unquoted
+		}
+	}
+	return name
+}
+
+// stripName removes strip leading components from a patch file name
+func stripName(name string, strip int) (string, error) {
+	stripped := name
+	for i := 0; i < strip; i++ {
+		slash := strings.IndexByte(stripped, '/')
+		if slash < 0 {
+			return "", fmt.Errorf("can not strip %d components from %s", strip, name)
+		}
+		stripped = strings.TrimLeft(stripped[slash+1:], "/")
+	}
+	return stripped, nil
+}
+
+// parseGitMode converts a git file mode into an os.FileMode
+func parseGitMode(text string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimSpace(text), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %s", text)
+	}
+
+	switch mode & 0170000 {
+	case 0120000:
+		return os.ModeSymlink | 0777, nil
+	case 0100000:
+		return os.FileMode(mode & 0777), nil
+	}
+	return 0, fmt.Errorf("unsupported mode %s", text)
+}
+
+// parseHunkHeader reads the ranges of an @@ -l,s +l,s @@ line
+func parseHunkHeader(text string) (*hunk, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 4 || fields[3] != "@@" || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return nil, fmt.Errorf("invalid hunk header %s", text)
+	}
+
+	h := &hunk{}
+	var err error
+	if h.oldStart, h.oldLines, err = parseRange(fields[1][1:]); err != nil {
+		return nil, fmt.Errorf("invalid hunk header %s", text)
+	}
+	if h.newStart, h.newLines, err = parseRange(fields[2][1:]); err != nil {
+		return nil, fmt.Errorf("invalid hunk header %s", text)
+	}
+	return h, nil
+}
+
+func parseRange(text string) (int, int, error) {
+	start, count := text, "1"
+	if i := strings.IndexByte(text, ','); i >= 0 {
+		start, count = text[:i], text[i+1:]
+	}
+
+	s, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	c, err := strconv.Atoi(count)
+	return s, c, err
+}
+
+// readLines reads the body of a hunk, returning the number of patch lines consumed
+func (h *hunk) readLines(lines []string) (int, error) {
+	oldLines, newLines := 0, 0
+	n := 0
+
+	for ; n < len(lines); n++ {
+		line := lines[n]
+
+		if strings.HasPrefix(line, "\\") {
+			// "\ No newline at end of file" applies to the line before it
+			if len(h.lines) > 0 {
+				last := h.lines[len(h.lines)-1]
+				h.lines[len(h.lines)-1] = strings.TrimSuffix(strings.TrimSuffix(last, "\n"), "\r")
+			}
+			continue
+		}
+
+		if oldLines == h.oldLines && newLines == h.newLines {
+			break
+		}
+
+		switch {
+		case line == "\n" || line == "\r\n":
+			// editors strip the trailing space of empty context lines
+			line = " " + line
+			fallthrough
+		case strings.HasPrefix(line, " "):
+			oldLines++
+			newLines++
+		case strings.HasPrefix(line, "-"):
+			oldLines++
+		case strings.HasPrefix(line, "+"):
+			newLines++
+		default:
+			return n, fmt.Errorf("hunk ends after %d of %d old and %d of %d new lines", oldLines, h.oldLines, newLines, h.newLines)
+		}
+
+		if oldLines > h.oldLines || newLines > h.newLines {
+			return n, fmt.Errorf("hunk is longer than its header says")
+		}
+
+		// the last line of a patch file may lack its newline, it is restored to match the file
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		h.lines = append(h.lines, line)
+	}
+
+	if oldLines != h.oldLines || newLines != h.newLines {
+		return n, fmt.Errorf("hunk ends after %d of %d old and %d of %d new lines", oldLines, h.oldLines, newLines, h.newLines)
+	}
+
+	return n, nil
+}
+
+// side returns the lines a hunk expects to find (old) or leaves behind (new) without their prefix
+func (h *hunk) side(old bool) []string {
+	var lines []string
+	for _, line := range h.lines {
+		if line[0] == ' ' || (old && line[0] == '-') || (!old && line[0] == '+') {
+			lines = append(lines, line[1:])
+		}
+	}
+	return lines
+}
+
+// context returns the number of context lines at the start and end of a hunk
+func (h *hunk) context() (int, int) {
+	leading := 0
+	for leading < len(h.lines) && h.lines[leading][0] == ' ' {
+		leading++
+	}
+
+	trailing := 0
+	for trailing < len(h.lines)-leading && h.lines[len(h.lines)-1-trailing][0] == ' ' {
+		trailing++
+	}
+
+	return leading, trailing
+}
+
+// applyHunks applies hunks to the lines of a file the way patch does: each hunk is searched for
+// outwards from where the previous hunks' offset puts it, and with fuzz up to that many lines of
+// leading and trailing context may be ignored.
+func applyHunks(name string, lines []string, hunks []*hunk, fuzz int) ([]string, []error) {
+	var out []string
+	var failures []error
+	cursor, offset := 0, 0
+
+	for n, h := range hunks {
+		before, after := h.side(true), h.side(false)
+		leading, trailing := h.context()
+
+		expected := h.oldStart - 1
+		if h.oldLines == 0 {
+			// pure additions go after the line they name
+			expected = h.oldStart
+		}
+
+		found, top, bottom := -1, 0, 0
+		for f := 0; f <= fuzz && found < 0; f++ {
+			top, bottom = min(f, leading), min(f, trailing)
+			if top+bottom > len(before) {
+				break
+			}
+			found = search(lines, before[top:len(before)-bottom], expected+offset+top, cursor)
+		}
+
+		if found < 0 {
+			failures = append(failures, &hunkError{
+				file:   name,
+				hunk:   n + 1,
+				line:   expected + offset + 1,
+				reason: mismatch(lines, before, expected+offset, cursor),
+			})
+			continue
+		}
+
+		out = append(out, lines[cursor:found]...)
+		out = append(out, after[top:len(after)-bottom]...)
+		cursor = found + len(before) - top - bottom
+		offset = found - top - expected
+
+		if top > 0 || bottom > 0 {
+			debug(fmt.Sprintf("%s: hunk #%d succeeded at %d with fuzz %d", name, n+1, found-top+1, max(top, bottom)))
+		}
+	}
+
+	return append(out, lines[cursor:]...), failures
+}
+
+// search returns the position closest to expected, and not before minimum, where want matches lines
+func search(lines []string, want []string, expected int, minimum int) int {
+	last := len(lines) - len(want)
+	if len(want) == 0 {
+		// without context there is nothing to search for
+		if expected >= minimum && expected <= len(lines) {
+			return expected
+		}
+		return -1
+	}
+
+	for d := 0; expected-d >= minimum || expected+d <= last; d++ {
+		if pos := expected - d; pos >= minimum && pos <= last && matches(lines[pos:], want) {
+			return pos
+		}
+		if pos := expected + d; d > 0 && pos >= minimum && pos <= last && matches(lines[pos:], want) {
+			return pos
+		}
+	}
+	return -1
+}
+
+func matches(lines []string, want []string) bool {
+	for i, line := range want {
+		if lines[i] != line {
+			return false
+		}
+	}
+	return true
+}
+
+// mismatch explains why a hunk does not apply at the position it names
+func mismatch(lines []string, want []string, expected int, minimum int) string {
+	if expected < minimum {
+		return "overlaps the previous hunk"
+	}
+
+	for i, line := range want {
+		if expected+i >= len(lines) {
+			return fmt.Sprintf("file ends at line %d, expected %q", len(lines), line)
+		}
+		if lines[expected+i] != line {
+			return fmt.Sprintf("line %d is %q, expected %q", expected+i+1, lines[expected+i], line)
+		}
+	}
+	return "no match found"
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// splitLines splits file contents into lines that keep their newline
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// patchedFile is the state of a file in a patchTree
+type patchedFile struct {
+	content string
+	mode    os.FileMode
+	exists  bool
+	changed bool
+}
+
+// patchTree holds the files changed by a patch until every change has applied
+type patchTree struct {
+	source string
+	files  map[string]*patchedFile
+}
+
+// path returns where name lives in the source tree, refusing names that leave it directly or through
+// a symlink in the tree. A symlink named by the patch is patched itself rather than followed.
+func (t *patchTree) path(name string) (string, error) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || escapes(clean) {
+		return "", fmt.Errorf("%s is outside of %s", name, t.source)
+	}
+
+	path, err := resolveInRoot(t.source, clean, false, false)
+	if err != nil {
+		return "", fmt.Errorf("%s is outside of %s: %v", name, t.source, err)
+	}
+	return path, nil
+}
+
+// read returns the current state of name, reading it from disk on first use
+func (t *patchTree) read(name string) (*patchedFile, error) {
+	if f, ok := t.files[name]; ok {
+		return f, nil
+	}
+
+	path, err := t.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &patchedFile{}
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		f.content, f.mode, f.exists = target, os.ModeSymlink|0777, true
+	case info.Mode().IsRegular():
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		f.content, f.mode, f.exists = string(data), info.Mode().Perm(), true
+	default:
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	t.files[name] = f
+	return f, nil
+}
+
+// apply applies the hunks and metadata changes of fp to the tree
+func (t *patchTree) apply(fp *filePatch, fuzz int) error {
+	name := fp.newName
+	if !fp.git && fp.oldName != "" && fp.newName != "" {
+		// plain diffs often name a backup copy on one side, patch whichever file exists
+		if f, err := t.read(fp.newName); err != nil || !f.exists {
+			name = fp.oldName
+		}
+	} else if fp.newName == "" {
+		name = fp.oldName
+	}
+
+	source := fp.oldName
+	if !fp.git {
+		source = name
+		if fp.oldName == "" {
+			source = ""
+		}
+	}
+
+	in := &patchedFile{}
+	if source != "" {
+		f, err := t.read(source)
+		if err != nil {
+			return err
+		}
+		if !f.exists {
+			return fmt.Errorf("%s: does not exist", source)
+		}
+		in = f
+	} else if f, err := t.read(name); err != nil {
+		return err
+	} else if f.exists {
+		return fmt.Errorf("%s: already exists", name)
+	}
+
+	if fp.oldMode != 0 && in.exists && fp.oldMode != in.mode {
+		warn(fmt.Sprintf("%s: expected mode %v, found %v", source, fp.oldMode, in.mode))
+	}
+
+	lines, failures := applyHunks(name, splitLines(in.content), fp.hunks, fuzz)
+	if len(failures) > 0 {
+		return &patchError{failures: failures}
+	}
+	content := strings.Join(lines, "")
+
+	if fp.newName == "" {
+		if content != "" {
+			return fmt.Errorf("%s: not empty after removing its contents", source)
+		}
+		*in = patchedFile{changed: true}
+		return nil
+	}
+
+	mode := in.mode
+	if fp.newMode != 0 {
+		mode = fp.newMode
+	} else if !in.exists {
+		mode = 0644
+	}
+
+	out, err := t.read(fp.newName)
+	if err != nil {
+		return err
+	}
+	*out = patchedFile{content: content, mode: mode, exists: true, changed: true}
+
+	if fp.git && fp.oldName != "" && fp.oldName != fp.newName && !fp.copy {
+		*in = patchedFile{changed: true}
+	}
+	return nil
+}
+
+// commit writes every changed file to disk
+func (t *patchTree) commit() error {
+	names := make([]string, 0, len(t.files))
+	for name, f := range t.files {
+		if f.changed {
+			names = append(names, name)
+		}
+	}
+
+	// removals first so a file can replace a directory of the same name
+	sort.SliceStable(names, func(i, j int) bool {
+		if t.files[names[i]].exists != t.files[names[j]].exists {
+			return !t.files[names[i]].exists
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		f := t.files[name]
+		path, err := t.path(name)
+		if err != nil {
+			return err
+		}
+
+		if !f.exists {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if f.mode&os.ModeSymlink != 0 {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(strings.TrimSuffix(f.content, "\n"), path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if info, err := os.Lstat(path); err == nil && !info.Mode().IsRegular() {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+
+		if err := ioutil.WriteFile(path, []byte(f.content), f.mode); err != nil {
+			return err
+		}
+
+		// WriteFile only applies the mode to files it creates
+		if err := os.Chmod(path, f.mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
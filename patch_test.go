@@ -0,0 +1,495 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFile is a file of a source tree before or after patching, a mode of 0 means 0644
+type testFile struct {
+	content string
+	mode    os.FileMode
+}
+
+// patchTest is a patch applied to a source tree, either giving the files expected afterwards or
+// failing with an error containing each of errors and leaving the tree as it was
+type patchTest struct {
+	name  string
+	files map[string]testFile
+	// symlinks are created in the source tree along with files, mapping their names to their targets
+	symlinks map[string]string
+	patch    string
+	strip    int
+	fuzz     int
+	want     map[string]testFile
+	errors   []string
+}
+
+const tenLines = "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+
+var patchTests = []patchTest{
+	{
+		name:  "unified",
+		files: map[string]testFile{"a.txt": {content: tenLines}},
+		patch: `--- a/a.txt	2020-01-01 00:00:00.000000000 +0000
++++ b/a.txt	2020-01-01 00:00:00.000000000 +0000
+@@ -4,3 +4,3 @@
+ 4
+-5
++five
+ 6
+`,
+		strip: 1,
+		want:  map[string]testFile{"a.txt": {content: "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n"}},
+	},
+	{
+		name:  "strip 0",
+		files: map[string]testFile{"dir/a.txt": {content: "a\n"}},
+		patch: `--- dir/a.txt
++++ dir/a.txt
+@@ -1 +1 @@
+-a
++b
+`,
+		want: map[string]testFile{"dir/a.txt": {content: "b\n"}},
+	},
+	{
+		name:  "offset",
+		files: map[string]testFile{"a.txt": {content: "new\nlines\nabove\n" + tenLines}},
+		patch: `--- a/a.txt
++++ b/a.txt
+@@ -4,3 +4,3 @@
+ 4
+-5
++five
+ 6
+@@ -8,3 +8,3 @@
+ 8
+-9
++nine
+ 10
+`,
+		strip: 1,
+		want:  map[string]testFile{"a.txt": {content: "new\nlines\nabove\n1\n2\n3\n4\nfive\n6\n7\n8\nnine\n10\n"}},
+	},
+	{
+		name:  "fuzz",
+		files: map[string]testFile{"a.txt": {content: "1\n2\n3\nfour\n5\n6\n7\n8\n9\n10\n"}},
+		patch: `--- a/a.txt
++++ b/a.txt
+@@ -4,3 +4,3 @@
+ 4
+-5
++five
+ 6
+`,
+		strip: 1,
+		fuzz:  1,
+		want:  map[string]testFile{"a.txt": {content: "1\n2\n3\nfour\nfive\n6\n7\n8\n9\n10\n"}},
+	},
+	{
+		name:  "context mismatch without fuzz",
+		files: map[string]testFile{"a.txt": {content: "1\n2\n3\nfour\n5\n6\n7\n8\n9\n10\n"}},
+		patch: `--- a/a.txt
++++ b/a.txt
+@@ -4,3 +4,3 @@
+ 4
+-5
++five
+ 6
+`,
+		strip:  1,
+		errors: []string{`a.txt: hunk #1 FAILED at 4: line 4 is "four\n", expected "4\n"`},
+	},
+	{
+		name: "failed hunks are all reported and nothing is written",
+		files: map[string]testFile{
+			"a.txt": {content: tenLines},
+			"b.txt": {content: "b\n"},
+		},
+		patch: `--- a/a.txt
++++ b/a.txt
+@@ -1,2 +1,2 @@
+-1
++one
+ 2
+@@ -5,2 +5,2 @@
+-missing
++gone
+ 6
+--- a/b.txt
++++ b/b.txt
+@@ -1 +1 @@
+-c
++d
+`,
+		strip: 1,
+		errors: []string{
+			`a.txt: hunk #2 FAILED at 5: line 5 is "5\n", expected "missing\n"`,
+			`b.txt: hunk #1 FAILED at 1: line 1 is "b\n", expected "c\n"`,
+		},
+	},
+	{
+		name:  "no newline at end of file",
+		files: map[string]testFile{"a.txt": {content: "a\nb"}},
+		patch: `--- a/a.txt
++++ b/a.txt
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++c
+`,
+		strip: 1,
+		want:  map[string]testFile{"a.txt": {content: "a\nc\n"}},
+	},
+	{
+		name:  "adding no newline at end of file",
+		files: map[string]testFile{"a.txt": {content: "a\nb\n"}},
+		patch: `--- a/a.txt
++++ b/a.txt
+@@ -1,2 +1,2 @@
+ a
+-b
++c
+\ No newline at end of file
+`,
+		strip: 1,
+		want:  map[string]testFile{"a.txt": {content: "a\nc"}},
+	},
+	{
+		name:  "git rename with changes",
+		files: map[string]testFile{"old.txt": {content: "a\nb\nc\n"}},
+		patch: `diff --git a/old.txt b/new.txt
+similarity index 66%
+rename from old.txt
+rename to new.txt
+index 1111111..2222222 100644
+--- a/old.txt
++++ b/new.txt
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+`,
+		strip: 1,
+		want:  map[string]testFile{"new.txt": {content: "a\nB\nc\n"}},
+	},
+	{
+		name:  "git rename without changes",
+		files: map[string]testFile{"dir/old name.txt": {content: "a\n"}},
+		patch: `diff --git a/dir/old name.txt b/dir/new name.txt
+similarity index 100%
+rename from dir/old name.txt
+rename to dir/new name.txt
+`,
+		strip: 1,
+		want:  map[string]testFile{"dir/new name.txt": {content: "a\n"}},
+	},
+	{
+		name:  "git copy",
+		files: map[string]testFile{"a.txt": {content: "a\n"}},
+		patch: `diff --git a/a.txt b/b.txt
+similarity index 100%
+copy from a.txt
+copy to b.txt
+`,
+		strip: 1,
+		want: map[string]testFile{
+			"a.txt": {content: "a\n"},
+			"b.txt": {content: "a\n"},
+		},
+	},
+	{
+		name:  "git mode change",
+		files: map[string]testFile{"run.sh": {content: "echo\n"}},
+		patch: `diff --git a/run.sh b/run.sh
+old mode 100644
+new mode 100755
+`,
+		strip: 1,
+		want:  map[string]testFile{"run.sh": {content: "echo\n", mode: 0755}},
+	},
+	{
+		name:  "git new and deleted files",
+		files: map[string]testFile{"gone.txt": {content: "a\nb\n"}},
+		patch: `diff --git a/gone.txt b/gone.txt
+deleted file mode 100644
+index 1111111..0000000
+--- a/gone.txt
++++ /dev/null
+@@ -1,2 +0,0 @@
+-a
+-b
+diff --git a/bin/new.sh b/bin/new.sh
+new file mode 100755
+index 0000000..1111111
+--- /dev/null
++++ b/bin/new.sh
+@@ -0,0 +1,2 @@
++#!/bin/sh
++echo
+`,
+		strip: 1,
+		want:  map[string]testFile{"bin/new.sh": {content: "#!/bin/sh\necho\n", mode: 0755}},
+	},
+	{
+		name:  "new file that exists",
+		files: map[string]testFile{"a.txt": {content: "a\n"}},
+		patch: `--- /dev/null
++++ b/a.txt
+@@ -0,0 +1 @@
++a
+`,
+		strip:  1,
+		errors: []string{"a.txt: already exists"},
+	},
+	{
+		name:  "name outside the source tree",
+		files: map[string]testFile{},
+		patch: `--- a/../escape.txt
++++ b/../escape.txt
+@@ -0,0 +1 @@
++a
+`,
+		strip:  1,
+		errors: []string{"../escape.txt is outside of"},
+	},
+	{
+		name:     "new file through a symlink leaving the source tree",
+		files:    map[string]testFile{},
+		symlinks: map[string]string{"link": "../outside"},
+		patch: `--- /dev/null
++++ b/link/escape.txt
+@@ -0,0 +1 @@
++a
+`,
+		strip:  1,
+		errors: []string{"link/escape.txt is outside of", "path leaves the output directory"},
+	},
+	{
+		name:     "existing file through an absolute symlink",
+		files:    map[string]testFile{},
+		symlinks: map[string]string{"etc": "/etc"},
+		patch: `--- a/etc/hostname
++++ b/etc/hostname
+@@ -1 +1 @@
+-a
++b
+`,
+		strip:  1,
+		errors: []string{"etc/hostname is outside of", "absolute symlink"},
+	},
+	{
+		name:     "symlink inside the source tree",
+		files:    map[string]testFile{"real/a.txt": {content: "a\n"}},
+		symlinks: map[string]string{"link": "real"},
+		patch: `--- a/link/a.txt
++++ b/link/a.txt
+@@ -1 +1 @@
+-a
++b
+`,
+		strip: 1,
+		want:  map[string]testFile{"real/a.txt": {content: "b\n"}},
+	},
+}
+
+func TestPatch(t *testing.T) {
+	for _, test := range patchTests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "patch")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+
+			source := filepath.Join(dir, "source")
+			writeTree(t, source, test.files)
+			for name, target := range test.symlinks {
+				if err := os.Symlink(target, filepath.Join(source, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			patchFile := filepath.Join(dir, "test.patch")
+			if err := ioutil.WriteFile(patchFile, []byte(test.patch), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err = Patch(source, []string{patchFile}, test.strip, test.fuzz)
+			if len(test.errors) == 0 {
+				if err != nil {
+					t.Fatalf("Patch() = %v", err)
+				}
+				checkTree(t, source, test.want)
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("Patch() succeeded, want an error containing %q", test.errors)
+			}
+			for _, want := range test.errors {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Patch() = %v, want an error containing %q", err, want)
+				}
+			}
+			checkTree(t, source, test.files)
+		})
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		oldName string
+		newName string
+		oldMode os.FileMode
+		newMode os.FileMode
+		hunks   int
+	}{
+		{
+			name:    "quoted git names",
+			patch:   "diff --git \"a/tab\\there\" \"b/tab\\there\"\nold mode 100644\nnew mode 100755\n",
+			oldName: "tab\there",
+			newName: "tab\there",
+			oldMode: 0644,
+			newMode: 0755,
+		},
+		{
+			name:    "symlink",
+			patch:   "diff --git a/link b/link\nnew file mode 120000\n--- /dev/null\n+++ b/link\n@@ -0,0 +1 @@\n+target\n\\ No newline at end of file\n",
+			newName: "link",
+			newMode: os.ModeSymlink | 0777,
+			hunks:   1,
+		},
+		{
+			name:    "text around the diff",
+			patch:   "From: someone\nSubject: fix\n\n---\n a.c | 2 +-\n\n--- a/a.c\n+++ b/a.c\n@@ -1 +1 @@\n-a\n+b\n-- \n2.30.0\n",
+			oldName: "a.c",
+			newName: "a.c",
+			hunks:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patches, err := parsePatch(test.patch, 1)
+			if err != nil {
+				t.Fatalf("parsePatch() = %v", err)
+			}
+			if len(patches) != 1 {
+				t.Fatalf("parsePatch() returned %d changes, want 1", len(patches))
+			}
+
+			fp := patches[0]
+			if fp.oldName != test.oldName || fp.newName != test.newName {
+				t.Errorf("names = %q, %q, want %q, %q", fp.oldName, fp.newName, test.oldName, test.newName)
+			}
+			if fp.oldMode != test.oldMode || fp.newMode != test.newMode {
+				t.Errorf("modes = %v, %v, want %v, %v", fp.oldMode, fp.newMode, test.oldMode, test.newMode)
+			}
+			if len(fp.hunks) != test.hunks {
+				t.Errorf("%d hunks, want %d", len(fp.hunks), test.hunks)
+			}
+		})
+	}
+}
+
+func TestParsePatchErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		err   string
+	}{
+		{"short hunk", "--- a/a\n+++ b/a\n@@ -1,2 +1,2 @@\n-a\n+b\n", "hunk ends after 1 of 2 old and 1 of 2 new lines"},
+		{"binary", "diff --git a/a.png b/a.png\nindex 1111111..2222222 100644\nGIT binary patch\n", "binary patches are not supported"},
+		{"hunk without file", "@@ -1 +1 @@\n-a\n+b\n", "hunk without a file header"},
+		{"strip too far", "--- a\n+++ a\n@@ -1 +1 @@\n-a\n+b\n", "can not strip 1 components from a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parsePatch(test.patch, 1)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parsePatch() = %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+// writeTree creates dir and files below it
+func writeTree(t *testing.T, dir string, files map[string]testFile) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, f.perm()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkTree fails unless the regular files below dir are exactly files
+func checkTree(t *testing.T, dir string, files map[string]testFile) {
+	found := make(map[string]bool)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		found[name] = true
+
+		want, ok := files[name]
+		if !ok {
+			t.Errorf("unexpected file %s", name)
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if string(data) != want.content {
+			t.Errorf("%s = %q, want %q", name, data, want.content)
+		}
+		if info.Mode().Perm() != want.perm() {
+			t.Errorf("%s has mode %v, want %v", name, info.Mode().Perm(), want.perm())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range files {
+		if !found[name] {
+			t.Errorf("missing file %s", name)
+		}
+	}
+}
+
+func (f testFile) perm() os.FileMode {
+	if f.mode == 0 {
+		return 0644
+	}
+	return f.mode
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/esplinux/espbuild/pkginfo"
+	"go.starlark.net/starlark"
+	"io"
+	"os"
+	"time"
+)
+
+// writePkgInfo writes opts.pkgInfo with the file list of entries as the first entry of an archive.
+// The build date is the source date epoch of reproducible archives and the current time otherwise.
+func writePkgInfo(tarWriter *tar.Writer, entries []tarEntry, opts tarOptions) error {
+	info := *opts.pkgInfo
+
+	info.BuildDate = time.Now().UTC().Truncate(time.Second)
+	if opts.reproducible {
+		info.BuildDate = opts.epoch.UTC()
+	}
+
+	info.Files = make([]pkginfo.File, 0, len(entries))
+	for _, entry := range entries {
+		sum := ""
+		if entry.header.Typeflag == tar.TypeReg {
+			var err error
+			if sum, err = sha256File(entry.file); err != nil {
+				return err
+			}
+		}
+		info.Files = append(info.Files, pkginfo.NewFile(entry.header, sum))
+	}
+
+	data, err := info.Marshal()
+	if err != nil {
+		return err
+	}
+
+	header := pkginfo.Header(data, info.BuildDate)
+	if opts.owner != nil {
+		opts.owner.apply(header)
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = tarWriter.Write(data)
+	return err
+}
+
+// sha256File returns the hex encoded sha256 of the contents of file
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// appendUnique appends the values not already in list
+func appendUnique(list []string, values []string) []string {
+	seen := make(map[string]bool)
+	for _, value := range list {
+		seen[value] = true
+	}
+
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// pkgInfoFromDict converts the pkginfo argument of tar() to a PkgInfo, name, version and rev are required
+func pkgInfoFromDict(fnName string, dict *starlark.Dict) (*pkginfo.PkgInfo, error) {
+	info := &pkginfo.PkgInfo{Depends: []string{}, Provides: []string{}}
+
+	texts := map[string]*string{
+		"name":        &info.Name,
+		"version":     &info.Version,
+		"rev":         &info.Rev,
+		"description": &info.Description,
+		"license":     &info.License,
+		"builder":     &info.Builder,
+	}
+	lists := map[string]*[]string{
+		"depends":  &info.Depends,
+		"provides": &info.Provides,
+	}
+
+	for _, item := range dict.Items() {
+		key, _ := starlark.AsString(item[0])
+
+		if field, ok := texts[key]; ok {
+			value, ok := starlark.AsString(item[1])
+			if !ok {
+				return nil, fmt.Errorf("%s: pkginfo %s must be a string, got %s", fnName, key, item[1].Type())
+			}
+			*field = value
+			continue
+		}
+
+		if field, ok := lists[key]; ok {
+			list, ok := item[1].(*starlark.List)
+			if !ok {
+				return nil, fmt.Errorf("%s: pkginfo %s must be a list of strings, got %s", fnName, key, item[1].Type())
+			}
+			for i := 0; i < list.Len(); i++ {
+				value, ok := starlark.AsString(list.Index(i))
+				if !ok {
+					return nil, fmt.Errorf("%s: pkginfo %s must be a list of strings, got %s", fnName, key, list.Index(i).Type())
+				}
+				*field = append(*field, value)
+			}
+			continue
+		}
+
+		return nil, fmt.Errorf("%s: unknown pkginfo field %s", fnName, item[0])
+	}
+
+	if info.Name == "" || info.Version == "" || info.Rev == "" {
+		return nil, fmt.Errorf("%s: pkginfo needs a name, version and rev", fnName)
+	}
+	return info, nil
+}
@@ -0,0 +1,153 @@
+// Package pkginfo reads and writes the .PKGINFO entry espbuild stores at the start of every package
+// so that tools can tell what a package is without extracting it.
+package pkginfo
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"os"
+	"time"
+)
+
+// Name is the name of the first entry of a package
+const Name = ".PKGINFO"
+
+// PkgInfo describes a package
+type PkgInfo struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	Rev         string    `json:"rev"`
+	Description string    `json:"description,omitempty"`
+	License     string    `json:"license,omitempty"`
+	Depends     []string  `json:"depends"`
+	Provides    []string  `json:"provides"`
+	BuildDate   time.Time `json:"build_date"`
+	Builder     string    `json:"builder"`
+	Files       []File    `json:"files"`
+}
+
+// File is an entry of a package
+type File struct {
+	Name string `json:"name"`
+	// Type is one of file, dir, symlink, hardlink, char, block and fifo
+	Type string `json:"type"`
+	// Mode holds the octal permissions including the setuid, setgid and sticky bits
+	Mode   string `json:"mode"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Link is the target of symlinks and hardlinks
+	Link string `json:"link,omitempty"`
+}
+
+// fileTypes maps tar entry types to File types
+var fileTypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// NewFile describes the archive entry header, sum is the sha256 of regular files
+func NewFile(header *tar.Header, sum string) File {
+	return File{
+		Name:   header.Name,
+		Type:   fileTypes[header.Typeflag],
+		Mode:   fmt.Sprintf("%04o", header.Mode&07777),
+		Size:   header.Size,
+		SHA256: sum,
+		Link:   header.Linkname,
+	}
+}
+
+// Header returns the tar header of a .PKGINFO entry holding data
+func Header(data []byte, modTime time.Time) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     Name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+	}
+}
+
+// Marshal encodes info as it is stored in a package
+func (info *PkgInfo) Marshal() ([]byte, error) {
+	return json.MarshalIndent(info, "", "  ")
+}
+
+// Read reads the .PKGINFO entry from the start of an uncompressed package
+func Read(reader io.Reader) (*PkgInfo, error) {
+	tr := tar.NewReader(reader)
+	header, err := tr.Next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("empty package")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if header.Name != Name {
+		return nil, fmt.Errorf("package does not start with %s", Name)
+	}
+
+	info := &PkgInfo{}
+	if err := json.NewDecoder(tr).Decode(info); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", Name, err)
+	}
+	return info, nil
+}
+
+// ReadFile reads the .PKGINFO entry of a package, which may be compressed with gzip, zstd or xz
+func ReadFile(path string) (*PkgInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	reader := bufio.NewReader(f)
+	magic, _ := reader.Peek(6)
+
+	var stream io.Reader = reader
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gzipStream, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = gzipStream.Close()
+		}()
+		stream = gzipStream
+
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zstdStream, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer zstdStream.Close()
+		stream = zstdStream
+
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		if stream, err = xz.NewReader(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := Read(stream)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often progress is redrawn on a terminal and logged otherwise
+const (
+	ttyInterval = 200 * time.Millisecond
+	logInterval = 10 * time.Second
+)
+
+// transfer is a download in progress
+type transfer struct {
+	// updated atomically as bytes arrive
+	done int64
+
+	name    string
+	total   int64
+	resumed int64
+	start   time.Time
+}
+
+// Write counts bytes as they are copied to the download cache
+func (t *transfer) Write(p []byte) (int, error) {
+	atomic.AddInt64(&t.done, int64(len(p)))
+	return len(p), nil
+}
+
+// rate returns the bytes per second received since the transfer started
+func (t *transfer) rate() float64 {
+	elapsed := time.Since(t.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&t.done)-t.resumed) / elapsed
+}
+
+// String describes the state of the transfer, "foo.tar.gz 1.2 MiB/4.0 MiB 512.0 KiB/s ETA 6s"
+func (t *transfer) String() string {
+	done := atomic.LoadInt64(&t.done)
+	rate := t.rate()
+
+	if t.total < 0 {
+		return fmt.Sprintf("%s %s %s/s", t.name, formatBytes(done), formatBytes(int64(rate)))
+	}
+
+	eta := "?"
+	if rate > 0 {
+		eta = (time.Duration(float64(t.total-done)/rate) * time.Second).String()
+	}
+	return fmt.Sprintf("%s %s/%s %s/s ETA %s", t.name, formatBytes(done), formatBytes(t.total), formatBytes(int64(rate)), eta)
+}
+
+// formatBytes formats n with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progressDisplay shows the transfers in progress, as a status line redrawn in place on a terminal
+// and as periodic log lines when stderr is redirected
+type progressDisplay struct {
+	mu        sync.Mutex
+	tty       bool
+	transfers []*transfer
+	drawn     bool
+	running   bool
+}
+
+// progress is the display shared by every download
+var progress = &progressDisplay{tty: isTerminal(os.Stderr)}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// terminalWidth returns the width of the terminal on stderr
+func terminalWidth() int {
+	ws, err := unix.IoctlGetWinsize(int(os.Stderr.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 {
+		return 80
+	}
+	return int(ws.Col)
+}
+
+// start begins displaying a transfer of total bytes, or -1 when the size is unknown, that has
+// already received done bytes in earlier attempts
+func (p *progressDisplay) start(name string, done int64, total int64) *transfer {
+	t := &transfer{done: done, name: name, total: total, resumed: done, start: time.Now()}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.transfers = append(p.transfers, t)
+	if !p.running {
+		p.running = true
+		go p.run()
+	}
+	return t
+}
+
+// finish stops displaying a transfer and logs how it went
+func (p *progressDisplay) finish(t *transfer, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, other := range p.transfers {
+		if other == t {
+			p.transfers = append(p.transfers[:i], p.transfers[i+1:]...)
+			break
+		}
+	}
+
+	if err == nil {
+		elapsed := time.Since(t.start).Round(time.Millisecond)
+		p.printLocked(fmt.Sprintf("Downloaded: %s %s in %v (%s/s)", t.name, formatBytes(atomic.LoadInt64(&t.done)), elapsed, formatBytes(int64(t.rate()))))
+	}
+}
+
+// println prints a message without it being garbled by the status line
+func (p *progressDisplay) println(message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.printLocked(message)
+}
+
+func (p *progressDisplay) printLocked(message string) {
+	p.clearLocked()
+	fmt.Fprintln(os.Stderr, message)
+	p.drawLocked()
+}
+
+func (p *progressDisplay) clearLocked() {
+	if p.drawn {
+		fmt.Fprint(os.Stderr, "\r\u001b[K")
+		p.drawn = false
+	}
+}
+
+// drawLocked redraws the status line, it does nothing unless stderr is a terminal
+func (p *progressDisplay) drawLocked() {
+	if !p.tty || len(p.transfers) == 0 {
+		return
+	}
+
+	parts := make([]string, len(p.transfers))
+	for i, t := range p.transfers {
+		parts[i] = t.String()
+	}
+
+	line := fmt.Sprintf("[%d] %s", len(p.transfers), strings.Join(parts, " | "))
+	if width := terminalWidth() - 1; len(line) > width {
+		line = line[:width]
+	}
+
+	fmt.Fprint(os.Stderr, "\r\u001b[K"+line)
+	p.drawn = true
+}
+
+// run updates the display until no transfers are left
+func (p *progressDisplay) run() {
+	interval := logInterval
+	if p.tty {
+		interval = ttyInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.mu.Lock()
+		if len(p.transfers) == 0 {
+			p.clearLocked()
+			p.running = false
+			p.mu.Unlock()
+			return
+		}
+
+		if p.tty {
+			p.drawLocked()
+		} else {
+			for _, t := range p.transfers {
+				fmt.Fprintln(os.Stderr, "Downloading: "+t.String())
+			}
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// gzipUnknownOS is the gzip header OS value that does not depend on the build machine
+const gzipUnknownOS = 255
+
+// sourceDateEpoch returns the time set by $SOURCE_DATE_EPOCH, or the unix epoch when it is unset,
+// see https://reproducible-builds.org/specs/source-date-epoch/
+func sourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Unix(0, 0), nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, fmt.Errorf("SOURCE_DATE_EPOCH %q is not a number of seconds", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// normalizeHeader removes everything from a header that depends on the build machine rather than
+// on the file: modification times are clamped to epoch, access and change times dropped, ownership
+// is mapped through idMap or zeroed and the group and other write bits the umask decides are
+// cleared. Permissions are only ever taken away, a 0600 file stays 0600.
+func normalizeHeader(header *tar.Header, epoch time.Time, idMap map[int]int) {
+	if header.ModTime.After(epoch) {
+		header.ModTime = epoch
+	}
+	header.ModTime = header.ModTime.Truncate(time.Second)
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+
+	header.Uid = idMap[header.Uid]
+	header.Gid = idMap[header.Gid]
+	header.Uname = ""
+	header.Gname = ""
+
+	if header.Typeflag == tar.TypeSymlink {
+		header.Mode = 0777
+	} else {
+		header.Mode &^= 0022
+	}
+}
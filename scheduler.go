@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+)
+
+// default limits of the download scheduler, overridden by the -jobs and -host-jobs flags
+const (
+	defaultJobs     = 8
+	defaultHostJobs = 2
+)
+
+// scheduler limits how many downloads run at once overall and against any single host, so cold
+// cache builds that load many build files do not open a flood of connections to one mirror
+type scheduler struct {
+	slots   chan struct{}
+	perHost int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+// downloadSlots is shared by every http download and git fetch, configured in main
+var downloadSlots = newScheduler(defaultJobs, defaultHostJobs)
+
+func newScheduler(jobs int, perHost int) *scheduler {
+	return &scheduler{
+		slots:   make(chan struct{}, jobs),
+		perHost: perHost,
+		hosts:   make(map[string]chan struct{}),
+	}
+}
+
+// acquire blocks until a download from host may start, the returned function releases the slot
+func (s *scheduler) acquire(host string) func() {
+	s.mu.Lock()
+	hostSlots, ok := s.hosts[host]
+	if !ok {
+		hostSlots = make(chan struct{}, s.perHost)
+		s.hosts[host] = hostSlots
+	}
+	s.mu.Unlock()
+
+	// wait for the host first so downloads queued behind a busy host do not hold global slots
+	hostSlots <- struct{}{}
+	s.slots <- struct{}{}
+
+	return func() {
+		<-s.slots
+		<-hostSlots
+	}
+}
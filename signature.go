@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// signature is a detached signature a download has to verify against before it is used
+type signature struct {
+	// location of the signature, either a url or a file shipped with the recipe
+	location string
+	// a key file or a directory of key files
+	keyring string
+}
+
+// signatureError is returned when a download does not carry a valid signature from the keyring
+type signatureError struct {
+	url    string
+	reason string
+}
+
+func (e *signatureError) Error() string {
+	return fmt.Sprintf("signature verification failed for %s: %s", e.url, e.reason)
+}
+
+// untrustedComment starts both minisign and signify signatures and keys
+const untrustedComment = "untrusted comment:"
+
+// verify checks the signature of the download from url. OpenPGP signatures, armored or binary, are
+// checked against an OpenPGP keyring, minisign and signify signatures against their public keys.
+func (s *signature) verify(url string, signed io.Reader) error {
+	sigData, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	keyring, err := readKeyring(s.keyring)
+	if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(sigData, []byte(untrustedComment)) {
+		err = verifyMinisign(keyring, sigData, signed)
+	} else {
+		err = verifyOpenPGP(keyring, sigData, signed)
+	}
+
+	if err != nil {
+		return &signatureError{url: url, reason: err.Error()}
+	}
+	return nil
+}
+
+// read returns the signature, downloading it through the download cache when it is a url
+func (s *signature) read() ([]byte, error) {
+	if !strings.Contains(s.location, "://") {
+		return ioutil.ReadFile(s.location)
+	}
+
+	entry, err := downloads.fetch([]string{s.location}, time.Second*30, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := downloads.open(entry)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return ioutil.ReadAll(f)
+}
+
+// readKeyring returns the contents of every key file in keyring, which may be a file or a directory
+func readKeyring(keyring string) ([][]byte, error) {
+	info, err := os.Stat(keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{keyring}
+	if info.IsDir() {
+		infos, err := ioutil.ReadDir(keyring)
+		if err != nil {
+			return nil, err
+		}
+
+		files = nil
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				files = append(files, filepath.Join(keyring, info.Name()))
+			}
+		}
+	}
+
+	var keys [][]byte
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, data)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keyring %s has no keys", keyring)
+	}
+	return keys, nil
+}
+
+// openPGPEntities parses OpenPGP keys in binary form or as any number of armored blocks
+func openPGPEntities(keyring [][]byte) (openpgp.EntityList, error) {
+	const armorStart = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+
+	var entities openpgp.EntityList
+	for _, data := range keyring {
+		if !bytes.Contains(data, []byte(armorStart)) {
+			list, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			entities = append(entities, list...)
+			continue
+		}
+
+		// exported keys are often concatenated, the armor decoder only reads the first block
+		blocks := strings.Split(string(data), armorStart)
+		for _, block := range blocks[1:] {
+			list, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armorStart + block))
+			if err != nil {
+				return nil, err
+			}
+			entities = append(entities, list...)
+		}
+	}
+
+	return entities, nil
+}
+
+func verifyOpenPGP(keyring [][]byte, sigData []byte, signed io.Reader) error {
+	entities, err := openPGPEntities(keyring)
+	if err != nil {
+		return fmt.Errorf("reading OpenPGP keyring: %w", err)
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(sigData), []byte("-----BEGIN")) {
+		block, err := armor.Decode(bytes.NewReader(sigData))
+		if err != nil {
+			return err
+		}
+		if block.Type != openpgp.SignatureType {
+			return fmt.Errorf("expected %s, got %s", openpgp.SignatureType, block.Type)
+		}
+		if sigData, err = ioutil.ReadAll(block.Body); err != nil {
+			return err
+		}
+	}
+
+	signer, err := openpgp.CheckDetachedSignature(entities, signed, bytes.NewReader(sigData))
+	if err == pgperrors.ErrUnknownIssuer {
+		return fmt.Errorf("not signed by a key in the keyring")
+	} else if err != nil {
+		return err
+	}
+
+	p, err := packet.Read(bytes.NewReader(sigData))
+	if err != nil {
+		return err
+	}
+
+	// version 3 signatures carry no expiry information
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	if sig.SigLifetimeSecs != nil && *sig.SigLifetimeSecs != 0 {
+		expiry := sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second)
+		if now.After(expiry) {
+			return fmt.Errorf("signature expired on %s", expiry.Format(time.RFC3339))
+		}
+	}
+
+	if len(signer.Revocations) > 0 {
+		return fmt.Errorf("key %016X has been revoked", signer.PrimaryKey.KeyId)
+	}
+
+	// the self signatures of the signing key say when it expires
+	var selfSigs []*packet.Signature
+	if signer.PrimaryKey.KeyId == *sig.IssuerKeyId {
+		for _, identity := range signer.Identities {
+			selfSigs = append(selfSigs, identity.SelfSignature)
+		}
+	} else {
+		for _, subkey := range signer.Subkeys {
+			if subkey.PublicKey.KeyId != *sig.IssuerKeyId {
+				continue
+			}
+			// a revocation takes the place of the binding signature of a subkey
+			if subkey.Sig.SigType == packet.SigTypeSubkeyRevocation {
+				return fmt.Errorf("subkey %016X of key %016X has been revoked", subkey.PublicKey.KeyId, signer.PrimaryKey.KeyId)
+			}
+			selfSigs = append(selfSigs, subkey.Sig)
+		}
+	}
+
+	for _, selfSig := range selfSigs {
+		if selfSig.KeyExpired(sig.CreationTime) {
+			return fmt.Errorf("key %016X had expired when the signature was made", *sig.IssuerKeyId)
+		}
+		// a key that expired after signing still vouches for what it signed, as gpg does
+		if selfSig.KeyExpired(now) {
+			warn(fmt.Sprintf("signature made by key %016X which has since expired", *sig.IssuerKeyId))
+		}
+	}
+
+	return nil
+}
+
+// minisign and signify keys and signatures start with an algorithm and a key number
+const (
+	minisignAlgorithmLen = 2
+	minisignKeyNumLen    = 8
+	minisignKeyLen       = minisignAlgorithmLen + minisignKeyNumLen + ed25519.PublicKeySize
+	minisignSigLen       = minisignAlgorithmLen + minisignKeyNumLen + ed25519.SignatureSize
+)
+
+// minisignKeys parses minisign and signify public keys, with or without their comment lines
+func minisignKeys(keyring [][]byte) map[uint64]ed25519.PublicKey {
+	keys := make(map[uint64]ed25519.PublicKey)
+	for _, data := range keyring {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, untrustedComment) {
+				continue
+			}
+
+			key, err := base64.StdEncoding.DecodeString(line)
+			if err != nil || len(key) != minisignKeyLen || string(key[:minisignAlgorithmLen]) != "Ed" {
+				continue
+			}
+
+			keyNum := binary.LittleEndian.Uint64(key[minisignAlgorithmLen:])
+			keys[keyNum] = ed25519.PublicKey(key[minisignAlgorithmLen+minisignKeyNumLen:])
+		}
+	}
+	return keys
+}
+
+// verifyMinisign checks a minisign signature, or a signify one which is the same without the trusted
+// comment. Minisign's prehashed ED signatures sign the blake2b-512 hash of the file.
+func verifyMinisign(keyring [][]byte, sigData []byte, signed io.Reader) error {
+	lines := strings.Split(strings.TrimSpace(string(sigData)), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+
+	if len(lines) < 2 {
+		return fmt.Errorf("truncated signature")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != minisignSigLen {
+		return fmt.Errorf("malformed signature")
+	}
+
+	algorithm := string(sig[:minisignAlgorithmLen])
+	keyNum := binary.LittleEndian.Uint64(sig[minisignAlgorithmLen:])
+	sig = sig[minisignAlgorithmLen+minisignKeyNumLen:]
+
+	key, ok := minisignKeys(keyring)[keyNum]
+	if !ok {
+		return fmt.Errorf("not signed by a key in the keyring, signed by %016X", keyNum)
+	}
+
+	var message []byte
+	switch algorithm {
+	case "Ed":
+		if message, err = ioutil.ReadAll(signed); err != nil {
+			return err
+		}
+	case "ED":
+		h, _ := blake2b.New512(nil)
+		if _, err := io.Copy(h, signed); err != nil {
+			return err
+		}
+		message = h.Sum(nil)
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", algorithm)
+	}
+
+	if !ed25519.Verify(key, message, sig) {
+		return fmt.Errorf("invalid signature from %016X", keyNum)
+	}
+
+	// minisign also signs the trusted comment, which must not be tampered with either
+	const trustedComment = "trusted comment: "
+	if len(lines) >= 4 && strings.HasPrefix(lines[2], trustedComment) {
+		globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+		if err != nil || len(globalSig) != ed25519.SignatureSize {
+			return fmt.Errorf("malformed trusted comment signature")
+		}
+
+		if !ed25519.Verify(key, append(sig, lines[2][len(trustedComment):]...), globalSig) {
+			return fmt.Errorf("invalid trusted comment signature from %016X", keyNum)
+		}
+	} else if algorithm == "ED" {
+		return fmt.Errorf("signature has no trusted comment")
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subkeySigned returns the public keyring of a new key, with its subkey revoked when revoked is set,
+// and a detached signature of message made by the subkey. The binding signature declares no key
+// flags, this version of openpgp can not write the cross-signature a signing flag requires.
+func subkeySigned(t *testing.T, message string, revoked bool) ([]byte, []byte) {
+	config := &packet.Config{RSABits: 1024}
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subkey := &entity.Subkeys[0]
+	binding := &packet.Signature{
+		SigType:      packet.SigTypeSubkeyBinding,
+		PubKeyAlgo:   entity.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now().Add(-time.Hour),
+		IssuerKeyId:  &entity.PrimaryKey.KeyId,
+	}
+	if revoked {
+		binding.SigType = packet.SigTypeSubkeyRevocation
+	}
+	if err := binding.SignKey(subkey.PublicKey, entity.PrivateKey, config); err != nil {
+		t.Fatal(err)
+	}
+	subkey.Sig = binding
+
+	var keyring bytes.Buffer
+	if err := entity.Serialize(&keyring); err != nil {
+		t.Fatal(err)
+	}
+
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   subkey.PublicKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &subkey.PublicKey.KeyId,
+	}
+	h := sha256.New()
+	h.Write([]byte(message))
+	if err := sig.Sign(h, subkey.PrivateKey, config); err != nil {
+		t.Fatal(err)
+	}
+
+	var sigData bytes.Buffer
+	if err := sig.Serialize(&sigData); err != nil {
+		t.Fatal(err)
+	}
+	return keyring.Bytes(), sigData.Bytes()
+}
+
+func TestVerifyOpenPGPSubkey(t *testing.T) {
+	const message = "release tarball\n"
+
+	for _, revoked := range []bool{false, true} {
+		keyring, sigData := subkeySigned(t, message, revoked)
+		err := verifyOpenPGP([][]byte{keyring}, sigData, strings.NewReader(message))
+		switch {
+		case !revoked && err != nil:
+			t.Errorf("verifyOpenPGP() = %v for a valid subkey", err)
+		case revoked && (err == nil || !strings.Contains(err.Error(), "has been revoked")):
+			t.Errorf("verifyOpenPGP() = %v for a revoked subkey, want it refused", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// splitRule assigns the files matching any of its globs to a package
+type splitRule struct {
+	pkg   string
+	globs []*regexp.Regexp
+}
+
+// partition assigns every file under baseDir to exactly one package, the first rule whose globs
+// match it or mainPkg when none do. Directories are not assigned themselves, they go with every
+// package that has files in them, empty directories are assigned like files. The files of each
+// package are returned in walk order, packages without files are left out except mainPkg.
+func partition(baseDir string, rules []splitRule, mainPkg string) (map[string][]string, error) {
+	var paths []string
+	leaf := make(map[string]bool)
+
+	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == baseDir {
+			return nil
+		}
+
+		paths = append(paths, path)
+		leaf[path] = true
+		leaf[filepath.Dir(path)] = false
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the archive names each package holds
+	members := map[string]map[string]bool{mainPkg: {}}
+	for _, path := range paths {
+		if !leaf[path] {
+			continue
+		}
+
+		name := archiveName(baseDir, path)
+		pkg := mainPkg
+		for _, rule := range rules {
+			if matchesAny(name, rule.globs) {
+				pkg = rule.pkg
+				break
+			}
+		}
+
+		if members[pkg] == nil {
+			members[pkg] = make(map[string]bool)
+		}
+		for ; name != "." && name != "/" && name != "" && !members[pkg][name]; name = filepath.Dir(name) {
+			members[pkg][name] = true
+		}
+	}
+
+	packages := make(map[string][]string)
+	for pkg, names := range members {
+		packages[pkg] = []string{}
+		for _, path := range paths {
+			if names[archiveName(baseDir, path)] {
+				packages[pkg] = append(packages[pkg], path)
+			}
+		}
+	}
+	return packages, nil
+}
+
+// newSplitRules compiles the globs of each package, rules are tried in the order given
+func newSplitRules(pkgs []string, globs [][]string) ([]splitRule, error) {
+	var rules []splitRule
+	for i, pkg := range pkgs {
+		rule := splitRule{pkg: pkg}
+		for _, glob := range globs[i] {
+			re, err := globRegexp(glob)
+			if err != nil {
+				return nil, fmt.Errorf("package %s: %v", pkg, err)
+			}
+			rule.globs = append(rule.globs, re)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
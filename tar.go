@@ -2,73 +2,111 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/esplinux/espbuild/pkginfo"
 	"go.starlark.net/starlark"
 	"golang.org/x/sys/unix"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// tarOptions control how Tar writes an archive
+type tarOptions struct {
+	// reproducible makes the archive depend only on the contents of the files, see normalizeHeader
+	reproducible bool
+	// epoch is the latest modification time stored when reproducible
+	epoch time.Time
+	// idMap maps uids and gids of the build machine to those stored when reproducible, others become 0
+	idMap map[int]int
+	// compression is one of none, gzip, xz and zstd, level is passed on to compress
+	compression string
+	level       int
+	// xattrNamespaces are the extended attributes stored, see inNamespaces
+	xattrNamespaces []string
+	// capabilities maps archive names to the security.capability attribute stored for them
+	capabilities map[string]string
+	// owner replaces the owner of every entry, owners set the owner and mode of single entries
+	owner  *owner
+	owners map[string]*ownership
+	// devices are added to the archive after the files
+	devices map[string]*device
+	// pkgInfo is written as the first entry of the archive with the file list filled in, see writePkgInfo
+	pkgInfo *pkginfo.PkgInfo
+	// scanELF adds the shared libraries ELF binaries need and provide to pkgInfo, those no package
+	// in installed provides are reported unless installed is nil
+	scanELF   bool
+	installed map[string]string
+}
+
+// tarEntry is an entry of an archive Tar writes along with the file holding its contents
+type tarEntry struct {
+	header *tar.Header
+	file   string
+}
+
 // Tar up a set of files and return the name of the tarfile
-func Tar(name string, baseDir string, files *starlark.List) (starlark.Value, error) {
-	f, err := os.Create(name)
+func Tar(name string, baseDir string, files []string, opts tarOptions) (starlark.Value, error) {
+	entries, err := tarEntries(baseDir, files, opts)
 	if err != nil {
 		return starlark.String(name), err
 	}
 
-	gZipWriter := gzip.NewWriter(f)
-	tarWriter := tar.NewWriter(gZipWriter)
-
-	iter := files.Iterate()
-	defer iter.Done()
+	f, err := os.Create(name)
+	if err != nil {
+		return starlark.String(name), err
+	}
 
-	var k starlark.Value
-	for iter.Next(&k) {
-		file, _ := starlark.AsString(k)
+	defer func() {
+		_ = f.Close()
+	}()
 
-		// Skip baseDir
-		if file == baseDir {
-			continue
-		}
+	compressor, err := compress(f, opts.compression, opts.level)
+	if err != nil {
+		return starlark.String(name), err
+	}
+	tarWriter := tar.NewWriter(compressor)
 
-		// ensure the file actually exists before trying to tar it
-		fileInfo, err := os.Lstat(file)
+	if opts.pkgInfo != nil && opts.scanELF {
+		deps, err := scanELF(entries)
 		if err != nil {
-			return starlark.String(name), fmt.Errorf("unable to tar files - %v", err.Error())
+			return starlark.String(name), err
 		}
 
-		name := fileInfo.Name()
-		if fileInfo.Mode()&os.ModeSymlink != 0 { // check if Symlink bit set
-			name, err = os.Readlink(file) // Set name to link
-			if err != nil {
-				return starlark.String(name), err
-			}
+		opts.pkgInfo.Depends = appendUnique(opts.pkgInfo.Depends, deps.depends)
+		opts.pkgInfo.Provides = appendUnique(opts.pkgInfo.Provides, deps.provides)
+		if opts.installed != nil {
+			reportMissing(opts.pkgInfo.Name, deps, opts.installed)
 		}
+	}
 
-		// create a new dir/file header
-		header, err := tar.FileInfoHeader(fileInfo, name)
-		if err != nil {
+	if opts.pkgInfo != nil {
+		if err := writePkgInfo(tarWriter, entries, opts); err != nil {
 			return starlark.String(name), err
 		}
+	}
 
-		// update the name to correctly reflect the desired destination when untaring
-		header.Name = strings.TrimPrefix(strings.Replace(file, baseDir, "", -1), string(filepath.Separator))
-
+	for _, entry := range entries {
 		// write the header
-		if err := tarWriter.WriteHeader(header); err != nil {
+		if err := tarWriter.WriteHeader(entry.header); err != nil {
 			return starlark.String(name), err
 		}
 
 		// return on non-regular files (thanks to [kumo](https://medium.com/@komuw/just-like-you-did-fbdd7df829d3) for this suggested update)
-		if !fileInfo.Mode().IsRegular() {
+		if entry.header.Typeflag != tar.TypeReg {
 			continue
 		}
 
 		// open files for taring
-		f, err := os.Open(file)
+		f, err := os.Open(entry.file)
 		if err != nil {
 			return starlark.String(name), err
 		}
@@ -89,128 +127,550 @@ func Tar(name string, baseDir string, files *starlark.List) (starlark.Value, err
 		return starlark.None, err
 	}
 
-	if err := gZipWriter.Close(); err != nil {
+	if err := compressor.Close(); err != nil {
+		return starlark.None, err
+	}
+
+	if err := f.Close(); err != nil {
 		return starlark.None, err
 	}
 
 	return starlark.String(name), nil
 }
 
-func dir(target string, source string) string {
+// tarEntries returns the archive entries of the files in paths followed by the declared devices
+func tarEntries(baseDir string, paths []string, opts tarOptions) ([]tarEntry, error) {
+	if opts.reproducible {
+		// walk order depends on the filesystem, archive order must not. Parents sort before children.
+		sort.Slice(paths, func(i, j int) bool {
+			return archiveName(baseDir, paths[i]) < archiveName(baseDir, paths[j])
+		})
+	}
+
+	var entries []tarEntry
+
+	// files with several links are stored once, later names become hardlinks to the first
+	linked := make(map[inode]int)
+
+	// capabilities and owners not yet applied to a file
+	capabilities := make(map[string]bool)
+	for name := range opts.capabilities {
+		capabilities[name] = true
+	}
+	owners := make(map[string]bool)
+	for name := range opts.owners {
+		owners[name] = true
+	}
+
+	names := make(map[string]bool)
+
+	// the names capabilities and owners were given for, by the entry they were applied to
+	capabilitySources := make(map[int]string)
+	ownerSources := make(map[int]string)
+
+	for _, file := range paths {
+		// Skip baseDir
+		if file == baseDir {
+			continue
+		}
+
+		// ensure the file actually exists before trying to tar it
+		fileInfo, err := os.Lstat(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to tar files - %v", err.Error())
+		}
+
+		name := fileInfo.Name()
+		if fileInfo.Mode()&os.ModeSymlink != 0 { // check if Symlink bit set
+			name, err = os.Readlink(file) // Set name to link
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// create a new dir/file header
+		header, err := tar.FileInfoHeader(fileInfo, name)
+		if err != nil {
+			return nil, err
+		}
+
+		// update the name to correctly reflect the desired destination when untaring
+		header.Name = archiveName(baseDir, file)
+
+		// the entry holding the contents, for hardlinks the one linked to
+		stored := len(entries)
+		if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok && fileInfo.Mode().IsRegular() && stat.Nlink > 1 {
+			key := inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+			if first, ok := linked[key]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = entries[first].header.Name
+				header.Size = 0
+				stored = first
+			} else {
+				linked[key] = stored
+			}
+		}
+
+		// hardlinks share the attributes of the entry they link to
+		if header.Typeflag != tar.TypeLink {
+			xattrs, err := readXattrs(file, opts.xattrNamespaces)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := opts.capabilities[header.Name]; ok && !fileInfo.Mode().IsRegular() {
+				return nil, fmt.Errorf("capabilities can only be set on regular files, %s is not", header.Name)
+			}
+
+			for attr, value := range xattrs {
+				if header.PAXRecords == nil {
+					header.PAXRecords = make(map[string]string)
+				}
+				header.PAXRecords[paxXattr+attr] = value
+			}
+		}
+
+		if opts.reproducible {
+			normalizeHeader(header, opts.epoch, opts.idMap)
+		}
+
+		// ownership is only ever recorded in the archive, the files keep belonging to the builder
+		if opts.owner != nil {
+			opts.owner.apply(header)
+		}
+		names[header.Name] = true
+		entries = append(entries, tarEntry{header: header, file: file})
+
+		// capabilities and owners belong to the inode, whichever of its names they are given for
+		if capability, ok := opts.capabilities[header.Name]; ok {
+			if other, ok := capabilitySources[stored]; ok && opts.capabilities[other] != capability {
+				return nil, fmt.Errorf("capabilities given for %s and %s differ, they are hardlinks of the same file", other, header.Name)
+			}
+			capabilitySources[stored] = header.Name
+
+			first := entries[stored].header
+			if first.PAXRecords == nil {
+				first.PAXRecords = make(map[string]string)
+			}
+			first.PAXRecords[paxXattr+xattrCapability] = capability
+			delete(capabilities, header.Name)
+		}
+		if o, ok := opts.owners[header.Name]; ok {
+			if other, ok := ownerSources[stored]; ok && *opts.owners[other] != *o {
+				return nil, fmt.Errorf("owners given for %s and %s differ, they are hardlinks of the same file", other, header.Name)
+			}
+			ownerSources[stored] = header.Name
+
+			o.apply(header)
+			o.apply(entries[stored].header)
+			delete(owners, header.Name)
+		}
+	}
+
+	if err := unmatched("capabilities", capabilities); err != nil {
+		return nil, err
+	}
+	if err := unmatched("owners", owners); err != nil {
+		return nil, err
+	}
+
+	var devices []string
+	for device := range opts.devices {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	for _, device := range devices {
+		if names[device] {
+			return nil, fmt.Errorf("device %s is already in the archive", device)
+		}
+		entries = append(entries, tarEntry{header: opts.devices[device].header(device, opts)})
+	}
+
+	return entries, nil
+}
+
+// archiveName returns the name file is stored under in an archive of baseDir
+func archiveName(baseDir string, file string) string {
+	return strings.TrimPrefix(strings.Replace(file, baseDir, "", -1), string(filepath.Separator))
+}
+
+// inode identifies a file independently of the names linked to it
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+func dir(target string, source string) (string, error) {
 	// todo: eric@ this is evil and likely to eventually break
 	// Assumption: The first directory present in the tarball is the source directory
 	// this is an imperfect assumption but should almost always be correct.
 
 	if fi, err := os.Lstat(target); !(err == nil && fi.IsDir()) {
 		if err = os.MkdirAll(target, 0755); err != nil {
-			fatal(err)
+			return source, err
 		}
 	}
 
 	if source == "" {
-		return target
+		return target, nil
 	}
 
-	return source
+	return source, nil
 }
 
-func file(header *tar.Header, reader io.Reader, target string) {
+func file(header *tar.Header, reader io.Reader, target string) error {
 	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
 	if err != nil {
-		fatal(err)
+		return err
 	}
 
 	// copy over contents
 	if _, err = io.Copy(f, reader); err != nil {
-		fatal(err)
+		_ = f.Close()
+		return err
 	}
 
 	// manually close here after each file operation; deferring would cause each file close
 	// to wait until all operations have completed.
-	if err = f.Close(); err != nil {
-		fatal(err)
-	}
+	return f.Close()
 }
 
-func link(header *tar.Header, target string) {
-	if err := os.Link(header.Linkname, target); err != nil {
-		fatal(err)
-	}
+// link creates target as a hardlink to linkTarget, the already extracted entry header.Linkname names
+func link(linkTarget string, target string) error {
+	return os.Link(linkTarget, target)
 }
 
-func symlink(header *tar.Header, target string) {
-	if err := os.Symlink(header.Linkname, target); err != nil {
-		fatal(err)
-	}
+func symlink(header *tar.Header, target string) error {
+	return os.Symlink(header.Linkname, target)
 }
 
-func char(header *tar.Header, target string) {
+func char(header *tar.Header, target string) error {
 	mode := uint32(header.Mode & 07777)
 	mode |= unix.S_IFCHR
 	device := int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
-	if err := unix.Mknod(target, mode, device); err != nil {
-		fatal(err)
-	}
+	return unix.Mknod(target, mode, device)
 }
 
-func block(header *tar.Header, target string) {
+func block(header *tar.Header, target string) error {
 	mode := uint32(header.Mode & 07777)
 	mode |= unix.S_IFBLK
 	device := int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
-	if err := unix.Mknod(target, mode, device); err != nil {
-		fatal(err)
-	}
+	return unix.Mknod(target, mode, device)
 }
 
-func fifo(header *tar.Header, target string) {
+func fifo(header *tar.Header, target string) error {
 	mode := uint32(header.Mode & 07777)
 	mode |= unix.S_IFIFO
 	device := int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
-	if err := unix.Mknod(target, mode, device); err != nil {
-		fatal(err)
-	}
+	return unix.Mknod(target, mode, device)
 }
 
-func processTarEntry(header *tar.Header, reader io.Reader, target string, source string) string {
+// entryError is returned when an archive entry can not be extracted
+type entryError struct {
+	name      string
+	entryType string
+	err       error
+}
+
+func (e *entryError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.entryType, e.name, e.err)
+}
+
+func (e *entryError) Unwrap() error {
+	return e.err
+}
+
+// entryTypes names the entry types processTarEntry supports in error messages
+var entryTypes = map[byte]string{
+	tar.TypeDir:     "directory",
+	tar.TypeReg:     "file",
+	tar.TypeLink:    "hardlink",
+	tar.TypeSymlink: "symlink",
+	tar.TypeChar:    "character device",
+	tar.TypeBlock:   "block device",
+	tar.TypeFifo:    "fifo",
+}
+
+func processTarEntry(header *tar.Header, reader io.Reader, target string, linkTarget string, source string) (string, error) {
 	// the following switch could also be done using fi.Mode(), not sure if there a benefit of using one vs. the other.
 	// fi := header.FileInfo()
 
+	var err error
 	switch header.Typeflag {
 
 	case tar.TypeDir:
-		source = dir(target, source)
+		source, err = dir(target, source)
 
 	case tar.TypeReg:
-		file(header, reader, target)
+		err = file(header, reader, target)
 
 	case tar.TypeLink:
-		link(header, target)
+		err = link(linkTarget, target)
 
 	case tar.TypeSymlink:
-		symlink(header, target)
+		err = symlink(header, target)
 
 	case tar.TypeChar:
-		char(header, target)
+		err = char(header, target)
 
 	case tar.TypeBlock:
-		block(header, target)
+		err = block(header, target)
 
 	case tar.TypeFifo:
-		fifo(header, target)
+		err = fifo(header, target)
 
 	case tar.TypeXGlobalHeader:
 		warn("ignoring unsupported PAX global header")
 
 	default:
-		fatal(fmt.Errorf("tar entry %s of %v is not supported", target, header.Typeflag))
+		return source, fmt.Errorf("tar entry %s of type %q is not supported", header.Name, header.Typeflag)
 	}
 
-	return source
+	if err != nil {
+		return source, &entryError{name: header.Name, entryType: entryTypes[header.Typeflag], err: err}
+	}
+	return source, nil
 }
 
-// UnTar a set of files and return the name of the first directory created
-func UnTar(reader io.Reader, outputDir string) (starlark.Value, error) {
+// extractOptions control what is extracted from an archive and how strictly entries are confined
+// to the output directory
+type extractOptions struct {
+	// absoluteSymlinks allows symlinks with absolute targets, which are taken to be relative to the
+	// output directory the way they are inside a root filesystem
+	absoluteSymlinks bool
+	// xattrNamespaces are the extended attributes restored, see inNamespaces
+	xattrNamespaces []string
+	// owners restores the owner and mode of entries, which is only wanted when installing packages
+	owners bool
+	// skipPkgInfo leaves out the .PKGINFO entry of packages
+	skipPkgInfo bool
+	// files, when set, are the entries the archive must hold keyed by cleanName, regular files with
+	// the recorded sha256. Installing checks a package before extracting it, this ties the two reads.
+	files map[string]pkginfo.File
+}
+
+// unsafeEntryError is returned for archive entries that would be written outside the output directory
+type unsafeEntryError struct {
+	name   string
+	reason string
+}
+
+func (e *unsafeEntryError) Error() string {
+	return fmt.Sprintf("refusing archive entry %s: %s", e.name, e.reason)
+}
+
+// maxSymlinks bounds how many symlinks are followed resolving one path, as ELOOP does
+const maxSymlinks = 40
+
+// escapes reports whether a cleaned relative path leaves the directory it is relative to
+func escapes(clean string) bool {
+	return clean == ".." || strings.HasPrefix(clean, "../")
+}
+
+// resolveInRoot resolves rel inside root the way the kernel would, following symlinks that already
+// exist there, and fails if that leaves root. The last component is only followed when followLast
+// is set. Absolute symlink targets restart from root when absoluteSymlinks is set and are refused
+// otherwise.
+func resolveInRoot(root string, rel string, followLast bool, absoluteSymlinks bool) (string, error) {
+	components := strings.Split(rel, "/")
+	var resolved []string
+	links := 0
+
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", errors.New("path leaves the output directory")
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		current := filepath.Join(root, filepath.Join(resolved...), component)
+		info, err := os.Lstat(current)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 || (len(components) == 0 && !followLast) {
+			resolved = append(resolved, component)
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", errors.New("too many levels of symbolic links")
+		}
+
+		linkname, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(linkname) {
+			if !absoluteSymlinks {
+				return "", fmt.Errorf("path passes through absolute symlink %s -> %s", filepath.Join(append(resolved, component)...), linkname)
+			}
+			resolved = nil
+		}
+		components = append(strings.Split(linkname, "/"), components...)
+	}
+
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
+
+// entryTarget returns where header is extracted inside outputDir and, for hardlinks, the path inside
+// outputDir of the entry linked to. Entries are refused when their name is absolute or leaves
+// outputDir, directly or through a symlink extracted earlier, and when they are links whose target
+// leaves it.
+func entryTarget(header *tar.Header, outputDir string, opts extractOptions) (string, string, error) {
+	unsafe := func(format string, args ...interface{}) error {
+		return &unsafeEntryError{name: header.Name, reason: fmt.Sprintf(format, args...)}
+	}
+
+	if filepath.IsAbs(header.Name) {
+		return "", "", unsafe("absolute name")
+	}
+
+	name := filepath.Clean(header.Name)
+	if escapes(name) {
+		return "", "", unsafe("name leaves the output directory")
+	}
+
+	// existing directories are reused, anything else is replaced rather than written through
+	target, err := resolveInRoot(outputDir, name, header.Typeflag == tar.TypeDir, opts.absoluteSymlinks)
+	if err != nil {
+		return "", "", unsafe("%v", err)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		if filepath.IsAbs(header.Linkname) && !opts.absoluteSymlinks {
+			return "", "", unsafe("absolute symlink target %s", header.Linkname)
+		}
+		if err := checkSymlink(outputDir, target, header.Linkname, opts); err != nil {
+			return "", "", unsafe("%v", err)
+		}
+
+	case tar.TypeLink:
+		if filepath.IsAbs(header.Linkname) || escapes(filepath.Clean(header.Linkname)) {
+			return "", "", unsafe("hardlink target %s leaves the output directory", header.Linkname)
+		}
+
+		// the link names an entry of the archive, never a path relative to the working directory
+		linkTarget, err := resolveInRoot(outputDir, filepath.Clean(header.Linkname), false, opts.absoluteSymlinks)
+		if err != nil {
+			return "", "", unsafe("hardlink target %s: %v", header.Linkname, err)
+		}
+		return target, linkTarget, nil
+	}
+
+	return target, "", nil
+}
+
+// checkSymlink fails when the symlink target pointing to linkname would lead out of outputDir,
+// following the symlinks extracted so far the same way entry names are resolved
+func checkSymlink(outputDir string, target string, linkname string, opts extractOptions) error {
+	dir, err := filepath.Rel(outputDir, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+
+	// not joined with filepath.Join, cleaning "b/.." would skip the symlink b. Absolute targets restart
+	// from outputDir inside resolveInRoot.
+	rel := linkname
+	if !filepath.IsAbs(linkname) {
+		rel = dir + "/" + linkname
+	}
+	if _, err := resolveInRoot(outputDir, rel, true, opts.absoluteSymlinks); err != nil {
+		return fmt.Errorf("symlink target %s: %v", linkname, err)
+	}
+	return nil
+}
+
+// prepareTarget removes whatever a non directory entry replaces so it is never written through
+func prepareTarget(header *tar.Header, target string) error {
+	if header.Typeflag == tar.TypeDir {
+		return nil
+	}
+
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		return os.Remove(target)
+	}
+	return nil
+}
+
+// expectedEntry checks header against opts.files and returns the reader to extract its contents from
+// along with a check of those contents to run once they are written
+func expectedEntry(header *tar.Header, reader io.Reader, opts extractOptions) (io.Reader, func() error, error) {
+	name := cleanName(header.Name)
+	if opts.files == nil || name == "" {
+		return reader, func() error { return nil }, nil
+	}
+
+	changed := &entryError{name: header.Name, entryType: entryTypes[header.Typeflag], err: errors.New("changed since the package was checked")}
+
+	expected, ok := opts.files[name]
+	actual := pkginfo.NewFile(header, expected.SHA256)
+	actual.Name = name
+	if !ok || actual != expected {
+		return nil, nil, changed
+	}
+	if header.Typeflag != tar.TypeReg {
+		return reader, func() error { return nil }, nil
+	}
+
+	h := sha256.New()
+	verify := func() error {
+		if hex.EncodeToString(h.Sum(nil)) != expected.SHA256 {
+			return changed
+		}
+		return nil
+	}
+	return io.TeeReader(reader, h), verify, nil
+}
+
+// removeCreated removes paths created by unTar, most recently created first
+func removeCreated(created []string) {
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(created[i]); err != nil {
+			warn(err.Error())
+		}
+	}
+}
+
+// UnTar a set of files and return the name of the first directory created, on failure
+// everything extracted so far is removed again
+func UnTar(reader io.Reader, outputDir string, opts extractOptions) (starlark.Value, error) {
+	// tarballs may be compressed with any format decompress understands
+	buffered := bufio.NewReaderSize(reader, sniffLen)
+	header, _ := buffered.Peek(sniffLen)
+	stream, closer, err := decompress(buffered, sniffCompression(header))
+	if err != nil {
+		return starlark.None, err
+	}
+	defer closer()
+
+	source, created, err := unTar(stream, outputDir, opts)
+	if err != nil {
+		// leave nothing of a failed extraction behind
+		removeCreated(created)
+		return starlark.None, err
+	}
+	return starlark.String(source), nil
+}
+
+// unTar a set of files and return the name of the first directory created along with
+// every path that did not exist before extraction
+func unTar(reader io.Reader, outputDir string, opts extractOptions) (string, []string, error) {
 	source := ""
+	var created []string
+
+	// symlinks are checked again once every entry is extracted, later symlinks may redirect a target
+	// that stayed inside outputDir when it was checked
+	var symlinks []*tar.Header
+	var symlinkTargets []string
 
 	// Derived from example by Steve Domino and extended by reading golang std library source
 	tr := tar.NewReader(reader)
@@ -221,19 +681,68 @@ func UnTar(reader io.Reader, outputDir string) (starlark.Value, error) {
 
 		// if no more files are found return
 		case err == io.EOF:
-			return starlark.String(source), nil
+			for i, header := range symlinks {
+				if err := checkSymlink(outputDir, symlinkTargets[i], header.Linkname, opts); err != nil {
+					return source, created, &unsafeEntryError{name: header.Name, reason: err.Error()}
+				}
+			}
+			return source, created, nil
 
 		// return any other error
 		case err != nil:
-			return starlark.None, err
+			return source, created, err
 
 		// if the header is nil, just skip it (not sure how this happens)
 		case header == nil:
 			continue
+
+		case opts.skipPkgInfo && header.Name == pkginfo.Name:
+			continue
 		}
 
 		// the target location where the dir/file should be created
-		target := filepath.Join(outputDir, header.Name)
-		source = processTarEntry(header, tr, target, source)
+		target, linkTarget, err := entryTarget(header, outputDir, opts)
+		if err != nil {
+			return source, created, err
+		}
+
+		// packages leave out the directories of declared devices, tarballs built from file lists any
+		parents, err := mkdirParents(outputDir, target)
+		created = append(created, parents...)
+		if err != nil {
+			return source, created, err
+		}
+		if source == "" && len(parents) > 0 {
+			source = parents[0]
+		}
+
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			created = append(created, target)
+		} else if err := prepareTarget(header, target); err != nil {
+			return source, created, err
+		}
+		contents, verify, err := expectedEntry(header, tr, opts)
+		if err != nil {
+			return source, created, err
+		}
+		if source, err = processTarEntry(header, contents, target, linkTarget, source); err != nil {
+			return source, created, err
+		}
+		if err := verify(); err != nil {
+			return source, created, err
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			symlinks = append(symlinks, header)
+			symlinkTargets = append(symlinkTargets, target)
+		}
+		if opts.owners {
+			if err := restoreOwner(header, target, outputDir); err != nil {
+				return source, created, &entryError{name: header.Name, entryType: entryTypes[header.Typeflag], err: err}
+			}
+		}
+		// after the owner, changing it clears security.capability
+		if err := restoreXattrs(header, target, opts.xattrNamespaces); err != nil {
+			return source, created, &entryError{name: header.Name, entryType: entryTypes[header.Typeflag], err: err}
+		}
 	}
 }
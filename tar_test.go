@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntry is an entry of an archive built for a test, a regular file unless typeflag says otherwise
+type testEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+// outsidePlaceholder in the target of an existing symlink stands for the absolute path of a
+// directory next to the output directory
+const outsidePlaceholder = "OUTSIDE"
+
+// unTarTest extracts entries into an output directory holding the existing symlinks, either giving
+// the files expected afterwards or failing with an error containing err. Nothing may ever be written
+// to the directory next to it.
+type unTarTest struct {
+	name             string
+	existing         map[string]string
+	entries          []testEntry
+	absoluteSymlinks bool
+	want             map[string]testFile
+	err              string
+}
+
+var unTarTests = []unTarTest{
+	{
+		name:    "plain files",
+		entries: []testEntry{{name: "dir/", typeflag: tar.TypeDir}, {name: "dir/a.txt", content: "a\n"}},
+		want:    map[string]testFile{"dir/a.txt": {content: "a\n"}},
+	},
+	{
+		name:    "name leaving the output directory",
+		entries: []testEntry{{name: "../outside/a.txt", content: "a\n"}},
+		err:     "name leaves the output directory",
+	},
+	{
+		name:    "name leaving the output directory after a directory",
+		entries: []testEntry{{name: "dir/../../outside/a.txt", content: "a\n"}},
+		err:     "name leaves the output directory",
+	},
+	{
+		name:    "absolute name",
+		entries: []testEntry{{name: "/etc/a.txt", content: "a\n"}},
+		err:     "absolute name",
+	},
+	{
+		name:    "absolute symlink",
+		entries: []testEntry{{name: "etc", typeflag: tar.TypeSymlink, linkname: "/etc"}},
+		err:     "absolute symlink target /etc",
+	},
+	{
+		name:    "relative symlink leaving the output directory",
+		entries: []testEntry{{name: "dir/link", typeflag: tar.TypeSymlink, linkname: "../../outside"}},
+		err:     "symlink target ../../outside: path leaves the output directory",
+	},
+	{
+		name: "symlink then file through it",
+		entries: []testEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "dir"},
+			{name: "dir/", typeflag: tar.TypeDir},
+			{name: "link/a.txt", content: "a\n"},
+		},
+		want: map[string]testFile{"dir/a.txt": {content: "a\n"}},
+	},
+	{
+		name:             "absolute symlink of a root filesystem then file through it",
+		absoluteSymlinks: true,
+		entries: []testEntry{
+			{name: "usr/lib/", typeflag: tar.TypeDir},
+			{name: "lib", typeflag: tar.TypeSymlink, linkname: "/usr/lib"},
+			{name: "lib/libc.so", content: "elf\n"},
+		},
+		want: map[string]testFile{"usr/lib/libc.so": {content: "elf\n"}},
+	},
+	{
+		name:             "absolute symlink of a root filesystem to its parent",
+		absoluteSymlinks: true,
+		entries: []testEntry{
+			{name: "root", typeflag: tar.TypeSymlink, linkname: "/.."},
+			{name: "root/outside/a.txt", content: "a\n"},
+		},
+		err: "path leaves the output directory",
+	},
+	{
+		name: "later symlink redirecting an earlier one",
+		entries: []testEntry{
+			{name: "y", typeflag: tar.TypeSymlink, linkname: "b/.."},
+			{name: "b", typeflag: tar.TypeSymlink, linkname: "."},
+		},
+		err: "refusing archive entry y: symlink target b/..",
+	},
+	{
+		name: "earlier symlink redirecting a later one",
+		entries: []testEntry{
+			{name: "b", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "y", typeflag: tar.TypeSymlink, linkname: "b/.."},
+		},
+		err: "refusing archive entry y: symlink target b/..",
+	},
+	{
+		name:     "existing absolute symlink",
+		existing: map[string]string{"link": outsidePlaceholder},
+		entries:  []testEntry{{name: "link/a.txt", content: "a\n"}},
+		err:      "path passes through absolute symlink",
+	},
+	{
+		name:     "existing symlink is replaced rather than written through",
+		existing: map[string]string{"a.txt": "../outside/a.txt"},
+		entries:  []testEntry{{name: "a.txt", content: "a\n"}},
+		want:     map[string]testFile{"a.txt": {content: "a\n"}},
+	},
+	{
+		name: "hardlink",
+		entries: []testEntry{
+			{name: "a.txt", content: "a\n"},
+			{name: "b.txt", typeflag: tar.TypeLink, linkname: "a.txt"},
+		},
+		want: map[string]testFile{"a.txt": {content: "a\n"}, "b.txt": {content: "a\n"}},
+	},
+	{
+		name:    "hardlink leaving the output directory",
+		entries: []testEntry{{name: "passwd", typeflag: tar.TypeLink, linkname: "../outside/passwd"}},
+		err:     "hardlink target ../outside/passwd leaves the output directory",
+	},
+	{
+		name:    "absolute hardlink",
+		entries: []testEntry{{name: "passwd", typeflag: tar.TypeLink, linkname: "/etc/passwd"}},
+		err:     "hardlink target /etc/passwd leaves the output directory",
+	},
+	{
+		name:     "hardlink through an existing symlink",
+		existing: map[string]string{"link": outsidePlaceholder},
+		entries:  []testEntry{{name: "passwd", typeflag: tar.TypeLink, linkname: "link/passwd"}},
+		err:      "hardlink target link/passwd",
+	},
+}
+
+func TestUnTar(t *testing.T) {
+	for _, test := range unTarTests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "untar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = os.RemoveAll(dir)
+			}()
+
+			out := filepath.Join(dir, "out")
+			outside := filepath.Join(dir, "outside")
+			writeTree(t, out, nil)
+			writeTree(t, outside, map[string]testFile{"passwd": {content: "root\n"}})
+			for name, target := range test.existing {
+				target = strings.Replace(target, outsidePlaceholder, outside, 1)
+				if err := os.Symlink(target, filepath.Join(out, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = UnTar(bytes.NewReader(testArchive(t, test.entries)), out, extractOptions{absoluteSymlinks: test.absoluteSymlinks})
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("UnTar() = %v", err)
+				}
+				checkTree(t, out, test.want)
+			} else if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("UnTar() = %v, want an error containing %q", err, test.err)
+			}
+
+			checkTree(t, outside, map[string]testFile{"passwd": {content: "root\n"}})
+		})
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	writeTree(t, filepath.Join(dir, "usr/lib"), nil)
+	for name, target := range map[string]string{
+		"lib":      "/usr/lib",
+		"rel":      "usr/lib",
+		"up":       "..",
+		"loop":     "loop",
+		"usr/lib2": "../usr/lib",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		rel              string
+		followLast       bool
+		absoluteSymlinks bool
+		want             string
+		err              string
+	}{
+		{rel: "usr/lib/libc.so", want: "usr/lib/libc.so"},
+		{rel: "./usr//lib/", want: "usr/lib"},
+		{rel: "rel/libc.so", want: "usr/lib/libc.so"},
+		{rel: "usr/lib2/libc.so", want: "usr/lib/libc.so"},
+		{rel: "rel", want: "rel"},
+		{rel: "rel", followLast: true, want: "usr/lib"},
+		{rel: "lib/libc.so", absoluteSymlinks: true, want: "usr/lib/libc.so"},
+		{rel: "lib/libc.so", err: "path passes through absolute symlink lib -> /usr/lib"},
+		{rel: "usr/../lib/../../etc", absoluteSymlinks: true, want: "etc"},
+		{rel: "lib/../../../etc", absoluteSymlinks: true, err: "path leaves the output directory"},
+		{rel: "up/etc/passwd", err: "path leaves the output directory"},
+		{rel: "loop/a", err: "too many levels of symbolic links"},
+	}
+
+	for _, test := range tests {
+		got, err := resolveInRoot(dir, test.rel, test.followLast, test.absoluteSymlinks)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("resolveInRoot(%q) = %q, %v, want an error containing %q", test.rel, got, err, test.err)
+			}
+			continue
+		}
+		if want := filepath.Join(dir, test.want); err != nil || got != want {
+			t.Errorf("resolveInRoot(%q) = %q, %v, want %q", test.rel, got, err, want)
+		}
+	}
+}
+
+// testArchive returns an uncompressed tar archive holding entries
+func testArchive(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.content)),
+		}
+		switch entry.typeflag {
+		case 0:
+			header.Typeflag = tar.TypeReg
+		case tar.TypeDir:
+			header.Mode = 0755
+		}
+		if header.Typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 )
@@ -19,6 +20,28 @@ func fatal(err error) {
 }
 
 func warn(message string) {
-	l := log.New(os.Stderr, "", 0)
-	l.Println("\u001b[33;1m" + message + "\u001b[0m")
+	progress.println("\u001b[33;1m" + message + "\u001b[0m")
+}
+
+// copyFile copies the contents of src to a new file dst created with mode
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	return out.Close()
 }
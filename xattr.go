@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+// paxXattr prefixes the PAX records GNU tar and bsdtar use for extended attributes
+const paxXattr = "SCHILY.xattr."
+
+// defaultXattrNamespaces are the extended attributes Tar stores and packages restore unless told
+// otherwise: file capabilities, SELinux labels and POSIX ACLs. Other security attributes belong to
+// the build machine, user attributes are mostly desktop metadata.
+var defaultXattrNamespaces = []string{xattrCapability, "security.selinux", "system.posix_acl_*"}
+
+// inNamespaces reports whether the attribute name is in one of namespaces, which may be whole
+// namespaces like "security", single attributes like "security.capability" or prefixes of
+// attributes ending in "*" like "system.posix_acl_*"
+func inNamespaces(name string, namespaces []string) bool {
+	for _, namespace := range namespaces {
+		if strings.HasSuffix(namespace, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(namespace, "*")) {
+				return true
+			}
+		} else if name == namespace || strings.HasPrefix(name, namespace+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// readXattrs returns the extended attributes of path, without following symlinks, that are in
+// namespaces. Filesystems without extended attributes have none.
+func readXattrs(path string, namespaces []string) (map[string]string, error) {
+	if len(namespaces) == 0 {
+		return nil, nil
+	}
+
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("listing extended attributes of %s: %w", path, err)
+	}
+
+	list := make([]byte, size)
+	if size, err = unix.Llistxattr(path, list); err != nil {
+		return nil, fmt.Errorf("listing extended attributes of %s: %w", path, err)
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		if !inNamespaces(name, namespaces) {
+			continue
+		}
+
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err == unix.ENODATA {
+			// removed since it was listed
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s of %s: %w", name, path, err)
+		}
+
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(path, name, value); err != nil {
+			return nil, fmt.Errorf("reading %s of %s: %w", name, path, err)
+		}
+		xattrs[name] = string(value[:size])
+	}
+
+	return xattrs, nil
+}
+
+// restoreXattrs sets the extended attributes recorded in header that are in namespaces on the
+// extracted target. Attributes the filesystem does not support or the user may not set are
+// skipped with a warning.
+func restoreXattrs(header *tar.Header, target string, namespaces []string) error {
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxXattr) {
+			continue
+		}
+
+		name := strings.TrimPrefix(key, paxXattr)
+		if !inNamespaces(name, namespaces) {
+			continue
+		}
+
+		err := unix.Lsetxattr(target, name, []byte(value), 0)
+		switch err {
+		case nil:
+		case unix.ENOTSUP, unix.EPERM, unix.EACCES:
+			warn(fmt.Sprintf("not restoring %s of %s: %v", name, header.Name, err))
+		default:
+			return fmt.Errorf("setting %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// capabilityNames are the Linux capabilities in the order of their numbers
+var capabilityNames = []string{
+	"chown", "dac_override", "dac_read_search", "fowner", "fsetid", "kill", "setgid", "setuid",
+	"setpcap", "linux_immutable", "net_bind_service", "net_broadcast", "net_admin", "net_raw",
+	"ipc_lock", "ipc_owner", "sys_module", "sys_rawio", "sys_chroot", "sys_ptrace", "sys_pacct",
+	"sys_admin", "sys_boot", "sys_nice", "sys_resource", "sys_time", "sys_tty_config", "mknod",
+	"lease", "audit_write", "audit_control", "setfcap", "mac_override", "mac_admin", "syslog",
+	"wake_alarm", "block_suspend", "audit_read", "perfmon", "bpf", "checkpoint_restore",
+}
+
+// the security.capability attribute, see struct vfs_cap_data in linux/capability.h
+const (
+	xattrCapability      = "security.capability"
+	vfsCapRevision2      = 0x02000000
+	vfsCapFlagsEffective = 0x000001
+)
+
+// encodeCapabilities converts capabilities in the text form setcap takes, "cap_net_raw+ep" or
+// "cap_chown,cap_fowner=ep cap_kill+i", to the value of the security.capability attribute
+func encodeCapabilities(text string) (string, error) {
+	var permitted, inheritable uint64
+	effective := false
+
+	clauses := strings.Fields(text)
+	if len(clauses) == 0 {
+		return "", fmt.Errorf("no capabilities in %q", text)
+	}
+
+	for _, clause := range clauses {
+		split := strings.IndexAny(clause, "=+-")
+		if split < 0 {
+			return "", fmt.Errorf("capabilities %q: %q has no flags", text, clause)
+		}
+
+		var caps uint64
+		if clause[:split] == "" || clause[:split] == "all" {
+			caps = 1<<uint(len(capabilityNames)) - 1
+		} else {
+			for _, name := range strings.Split(clause[:split], ",") {
+				number := -1
+				for i, capability := range capabilityNames {
+					if strings.ToLower(name) == "cap_"+capability {
+						number = i
+					}
+				}
+				if number < 0 {
+					return "", fmt.Errorf("capabilities %q: unknown capability %s", text, name)
+				}
+				caps |= 1 << uint(number)
+			}
+		}
+
+		// operators and flags alternate, "+ep-i"
+		actions := clause[split:]
+		for len(actions) > 0 {
+			operator := actions[0]
+			end := strings.IndexAny(actions[1:], "=+-") + 1
+			if end == 0 {
+				end = len(actions)
+			}
+			flags := actions[1:end]
+			actions = actions[end:]
+
+			if operator == '=' {
+				permitted &^= caps
+				inheritable &^= caps
+			}
+
+			for _, flag := range flags {
+				switch flag {
+				case 'p':
+					if operator == '-' {
+						permitted &^= caps
+					} else {
+						permitted |= caps
+					}
+				case 'i':
+					if operator == '-' {
+						inheritable &^= caps
+					} else {
+						inheritable |= caps
+					}
+				case 'e':
+					// files have a single effective bit raising every permitted capability
+					effective = operator != '-'
+				default:
+					return "", fmt.Errorf("capabilities %q: unknown flag %c", text, flag)
+				}
+			}
+		}
+	}
+
+	magic := uint32(vfsCapRevision2)
+	if effective {
+		magic |= vfsCapFlagsEffective
+	}
+
+	var value bytes.Buffer
+	for _, field := range []uint32{magic, uint32(permitted), uint32(inheritable), uint32(permitted >> 32), uint32(inheritable >> 32)} {
+		_ = binary.Write(&value, binary.LittleEndian, field)
+	}
+	return value.String(), nil
+}